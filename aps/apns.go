@@ -19,11 +19,31 @@ var oidUid = []int{0, 9, 2342, 19200300, 100, 1, 1}
 var productionOID = []int{1, 2, 840, 113635, 100, 6, 3, 2}
 
 var client apns.Client
-var db *database.Database
+var db database.Store
 var redisClient *redis.Client
 var mapMutex = &sync.Mutex{}
-var delayedApns = make(map[database.Registration]time.Time)
+
+// delayed registrations and when their notification is due
+var delayedApns = make(map[database.Registration]delayedNotification)
 var delayTime = 30
+var breaker *circuitBreaker
+var topic string
+var certificateExpiry time.Time
+
+type delayedNotification struct {
+	due time.Time
+	// logs the send with the fields of the request that asked for it
+	logger *log.Entry
+}
+
+// how long to wait for the APNS client to accept a notification before the
+// gateway is considered unreachable
+const sendTimeout = 10 * time.Second
+
+// notifications that may wait for the APNS client to accept them
+const outboxSize = 1024
+
+var out *outbox
 
 func NewApns(
 	certFile string,
@@ -31,11 +51,14 @@ func NewApns(
 	checkDelayedInterval int,
 	delayMessageTime int,
 	feedbackInterval int,
-	database *database.Database,
+	database database.Store,
 	redisEnabled bool,
 	redisURL string,
 	redisPassword string,
-	redisDb int) string {
+	redisDb int,
+	failureThreshold int,
+	minBackoff int,
+	maxBackoff int) string {
 	log.Debugln("APNS for non NewMessage events will be delayed for", time.Second*time.Duration(delayTime))
 	delayTime = delayMessageTime
 	db = database
@@ -45,6 +68,7 @@ func NewApns(
 		log.Fatalln("Could not parse apns topic from certificate: ", err)
 	}
 	log.Debugln("Topic is", certtopic)
+	topic = certtopic
 
 	log.Debugln("Creating APNS client to", apns.ProductionGateway)
 	client, err = apns.NewClientWithFiles(apns.ProductionGateway, certFile, keyFile)
@@ -52,6 +76,14 @@ func NewApns(
 		log.Fatal("Could not create client: ", err.Error())
 	}
 
+	breaker = newCircuitBreaker(failureThreshold, time.Second*time.Duration(minBackoff), time.Second*time.Duration(maxBackoff))
+	breaker.probe = func() error {
+		return probeGateway(certFile, keyFile)
+	}
+	breaker.flush = sendCatchUp
+	out = newOutbox(outboxSize, sendTimeout, client.Send, breaker)
+	go out.run()
+
 	if redisEnabled {
 		redisClient = redis.NewClient(&redis.Options{
 			Addr:     redisURL,
@@ -70,8 +102,7 @@ func NewApns(
 		go func() {
 			for range feedbackTicker.C {
 				for f := range feedback.Receive() {
-					if !db.DeleteIfExistRegistration(f.DeviceToken, f.Timestamp) &&
-						redisEnabled {
+					if !removeDevice(f.DeviceToken, f.Timestamp) && redisEnabled {
 						redisClient.HSet("xapsd", f.DeviceToken, f.Timestamp.Format(timeLayout))
 					}
 				}
@@ -85,7 +116,7 @@ func NewApns(
 						if err != nil {
 							log.Errorln(err)
 						}
-						if db.DeleteIfExistRegistration(key, t) {
+						if removeDevice(key, t) {
 							redisClient.HDel("xapsd", key)
 						}
 					}
@@ -94,11 +125,7 @@ func NewApns(
 		}()
 	}
 
-	go func() {
-		for f := range client.FailedNotifs {
-			log.Println("Notification", f.Notif.ID, "failed with", f.Err.Error())
-		}
-	}()
+	go handleFailedNotifications()
 
 	delayedNotificationTicker := time.NewTicker(time.Second * time.Duration(checkDelayedInterval))
 	go func() {
@@ -110,34 +137,97 @@ func NewApns(
 	return certtopic
 }
 
+// removeDevice removes the registrations of a device that the feedback
+// service reported as gone, and drops their pending notifications. It
+// returns whether any registration was removed.
+func removeDevice(deviceToken string, timestamp time.Time) bool {
+	removed, err := db.DeleteIfExistRegistration(deviceToken, timestamp)
+	if err != nil {
+		log.Errorln("Cannot remove registrations of device", deviceToken, ":", err)
+	}
+	for _, registration := range removed {
+		log.Infoln("Removed registration", registration.AccountId, "/", registration.DeviceToken, "of a device that is gone since", timestamp)
+	}
+	CancelNotifications(removed)
+	return len(removed) != 0
+}
+
+func handleFailedNotifications() {
+	for f := range client.FailedNotifs {
+		log.Println("Notification", f.Notif.ID, "failed with", f.Err.Error())
+		if isThrottled(f.Err) {
+			breaker.park(database.Registration{
+				DeviceToken: f.Notif.DeviceToken,
+				AccountId:   f.Notif.Payload.APS.AccountId,
+			})
+			breaker.trip(&f.Err)
+		}
+	}
+}
+
+func sendCatchUp(registration database.Registration) {
+	SendNotification(registration, false, nil)
+}
+
 func checkDelayed() {
 	log.Debugln("Checking all delayed APNS")
-	var sendNow []database.Registration
+	due := make(map[database.Registration]*log.Entry)
 	mapMutex.Lock()
-	for reg, t := range delayedApns {
-		log.Debugln("Registration", reg.AccountId, "/", reg.DeviceToken, "has been waiting for", time.Since(t))
-		if time.Since(t) > time.Second*time.Duration(delayTime) {
-			sendNow = append(sendNow, reg)
+	now := time.Now()
+	for reg, delayed := range delayedApns {
+		log.Debugln("Registration", reg.AccountId, "/", reg.DeviceToken, "is due in", delayed.due.Sub(now))
+		if !now.Before(delayed.due) {
+			due[reg] = delayed.logger
 			delete(delayedApns, reg)
 		}
 	}
 	mapMutex.Unlock()
-	for _, reg := range sendNow {
-		SendNotification(reg, false)
+	for reg, logger := range due {
+		SendNotification(reg, false, logger)
 	}
 }
 
-func SendNotification(registration database.Registration, delayed bool) {
-	mapMutex.Lock()
+// SendNotification sends a notification to the registration, right away or
+// after the default delay. Everything about it is logged with the logger,
+// which may be nil.
+func SendNotification(registration database.Registration, delayed bool, logger *log.Entry) {
 	if delayed {
-		delayedApns[registration] = time.Now()
-		mapMutex.Unlock()
+		SendNotificationAfter(registration, time.Second*time.Duration(delayTime), logger)
 		return
-	} else {
+	}
+	mapMutex.Lock()
+	delete(delayedApns, registration)
+	mapMutex.Unlock()
+	if logger == nil {
+		logger = log.NewEntry(log.StandardLogger())
+	}
+	sendNow(registration, logger)
+}
+
+// SendNotificationAfter sends the notification once the delay has passed.
+// Another notification for the same registration within that time restarts
+// the delay, so a burst of events results in a single notification.
+func SendNotificationAfter(registration database.Registration, delay time.Duration, logger *log.Entry) {
+	mapMutex.Lock()
+	delayedApns[registration] = delayedNotification{due: time.Now().Add(delay), logger: logger}
+	mapMutex.Unlock()
+}
+
+// CancelNotifications drops the delayed and parked notifications of the
+// registrations, which were removed.
+func CancelNotifications(registrations []database.Registration) {
+	mapMutex.Lock()
+	for _, registration := range registrations {
 		delete(delayedApns, registration)
 	}
 	mapMutex.Unlock()
-	log.Debugln("Sending notification to", registration.AccountId, "/", registration.DeviceToken)
+	if breaker != nil {
+		breaker.unpark(registrations)
+	}
+}
+
+func sendNow(registration database.Registration, logger *log.Entry) {
+	logger.Debugln("Sending notification to", registration.AccountId, "/", registration.DeviceToken)
 	payload := apns.NewPayload()
 	payload.APS.AccountId = registration.AccountId
 	notification := apns.NewNotification()
@@ -147,7 +237,59 @@ func SendNotification(registration database.Registration, delayed bool) {
 	// https://developer.apple.com/library/content/documentation/NetworkingInternet/Conceptual/RemoteNotificationsPG/CommunicatingwithAPNs.html
 	t := time.Now().Add(24 * time.Hour)
 	notification.Expiration = &t
-	client.Send(notification)
+
+	if !breaker.allow() {
+		logger.Debugln("APNS circuit is open, parking notification for", registration.AccountId, "/", registration.DeviceToken)
+		breaker.park(registration)
+		return
+	}
+	out.push(registration, notification, logger)
+}
+
+// probeGateway opens and closes a connection to the APNS gateway to find out
+// whether it is reachable again.
+func probeGateway(certFile, keyFile string) error {
+	conn, err := apns.NewConnWithFiles(apns.ProductionGateway, certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	err = conn.Connect()
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// isThrottled reports whether the gateway rejected a notification because it
+// is overloaded or going away, rather than because of the notification itself.
+func isThrottled(err apns.Error) bool {
+	return err.ErrStr == apns.ErrShutdown || err.ErrStr == apns.ErrProcessing
+}
+
+// Status describes the state of the APNS delivery.
+type Status struct {
+	Topic             string
+	CertificateExpiry time.Time
+	// notifications waiting for their delay to pass
+	Delayed int
+	// registrations waiting for a catch-up notification after an outage
+	Parked      int
+	Unavailable bool
+}
+
+func CurrentStatus() Status {
+	mapMutex.Lock()
+	status := Status{
+		Topic:             topic,
+		CertificateExpiry: certificateExpiry,
+		Delayed:           len(delayedApns),
+	}
+	mapMutex.Unlock()
+	if breaker != nil {
+		status.Parked = breaker.parkedCount()
+		status.Unavailable = breaker.isOpen()
+	}
+	return status
 }
 
 func topicFromCertificate(filename string) (string, error) {
@@ -164,6 +306,7 @@ func topicFromCertificate(filename string) (string, error) {
 	if err != nil {
 		log.Fatalln("Could not parse certificate: ", err)
 	}
+	certificateExpiry = cert.NotAfter
 
 	if len(cert.Subject.Names) == 0 {
 		return "", errors.New("Subject.Names is empty")
@@ -0,0 +1,64 @@
+package aps
+
+import (
+	"github.com/st3fan/dovecot-xaps-daemon/database"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_RemoveDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apns_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "database.json")
+	store, err := database.NewDatabase(filename)
+	if err != nil {
+		t.Fatal("Cannot open database", err)
+	}
+
+	db, breaker = store, newCircuitBreaker(1, time.Hour, time.Hour)
+	defer func() {
+		db, breaker = nil, nil
+	}()
+
+	gone := database.Registration{DeviceToken: "gonetoken", AccountId: "goneaccount"}
+	kept := database.Registration{DeviceToken: "kepttoken", AccountId: "keptaccount"}
+	store.AddRegistration("stefan", gone.AccountId, gone.DeviceToken, []string{"INBOX"})
+	store.AddRegistration("stefan", kept.AccountId, kept.DeviceToken, []string{"INBOX"})
+	SendNotificationAfter(gone, time.Hour, nil)
+	SendNotificationAfter(kept, time.Hour, nil)
+	breaker.park(gone)
+	defer CancelNotifications([]database.Registration{kept})
+
+	if removeDevice("unknowntoken", time.Now()) {
+		t.Error("Removed an unknown device")
+	}
+	if !removeDevice(gone.DeviceToken, time.Now().Add(time.Second)) {
+		t.Error("Did not remove the device")
+	}
+
+	mapMutex.Lock()
+	_, goneDelayed := delayedApns[gone]
+	_, keptDelayed := delayedApns[kept]
+	mapMutex.Unlock()
+	if goneDelayed || !keptDelayed {
+		t.Error("Unexpected delayed notifications", goneDelayed, keptDelayed)
+	}
+	if breaker.parkedCount() != 0 {
+		t.Error("Removed registration is still parked")
+	}
+
+	reopened, err := database.NewDatabase(filename)
+	if err != nil {
+		t.Fatal("Cannot open database", err)
+	}
+	accounts, _ := reopened.ListAccounts("stefan")
+	if _, ok := accounts[gone.AccountId]; ok || len(accounts) != 1 {
+		t.Error("Removal was not written to disk", accounts)
+	}
+}
@@ -0,0 +1,144 @@
+package aps
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/st3fan/dovecot-xaps-daemon/database"
+	"sync"
+	"time"
+)
+
+// circuitBreaker guards the delivery to the APNS gateway. After a number of
+// consecutive failures, or immediately when the gateway tells us to back off,
+// the circuit opens. While it is open notifications are parked instead of
+// sent, coalesced per registration. The gateway is probed with an exponential
+// backoff and once it can be reached again the circuit closes and every
+// parked registration gets exactly one catch-up notification.
+type circuitBreaker struct {
+	mutex      sync.Mutex
+	open       bool
+	failures   int
+	threshold  int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	parked     map[database.Registration]time.Time
+
+	// probe tries to reach the gateway, flush sends a catch-up notification
+	probe func() error
+	flush func(database.Registration)
+}
+
+func newCircuitBreaker(threshold int, minBackoff, maxBackoff time.Duration) *circuitBreaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	if maxBackoff < minBackoff {
+		maxBackoff = minBackoff
+	}
+	return &circuitBreaker{
+		threshold:  threshold,
+		minBackoff: minBackoff,
+		maxBackoff: maxBackoff,
+		parked:     make(map[database.Registration]time.Time),
+	}
+}
+
+// allow reports whether notifications may be sent to the gateway right now.
+func (b *circuitBreaker) allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return !b.open
+}
+
+// isOpen reports whether the circuit is currently open.
+func (b *circuitBreaker) isOpen() bool {
+	return !b.allow()
+}
+
+// park remembers a registration that could not be notified. Parking the same
+// registration several times results in a single catch-up notification.
+func (b *circuitBreaker) park(registration database.Registration) {
+	b.mutex.Lock()
+	if _, ok := b.parked[registration]; !ok {
+		b.parked[registration] = time.Now()
+	}
+	b.mutex.Unlock()
+}
+
+// unpark forgets registrations that no longer exist, they get no catch-up.
+func (b *circuitBreaker) unpark(registrations []database.Registration) {
+	b.mutex.Lock()
+	for _, registration := range registrations {
+		delete(b.parked, registration)
+	}
+	b.mutex.Unlock()
+}
+
+// parkedCount returns the number of registrations waiting for a catch-up.
+func (b *circuitBreaker) parkedCount() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return len(b.parked)
+}
+
+// success resets the failure counter after a successful send.
+func (b *circuitBreaker) success() {
+	b.mutex.Lock()
+	b.failures = 0
+	b.mutex.Unlock()
+}
+
+// failure records a failed send, e.g. when the gateway could not be reached.
+// The circuit opens once the threshold of consecutive failures is reached.
+func (b *circuitBreaker) failure(err error) {
+	b.mutex.Lock()
+	b.failures++
+	trip := b.failures >= b.threshold
+	b.mutex.Unlock()
+	if trip {
+		b.trip(err)
+	}
+}
+
+// trip opens the circuit immediately, e.g. when the gateway is throttling us.
+func (b *circuitBreaker) trip(err error) {
+	b.mutex.Lock()
+	if b.open {
+		b.mutex.Unlock()
+		return
+	}
+	b.open = true
+	b.mutex.Unlock()
+
+	log.Warnln("APNS circuit opened, parking notifications:", err)
+	go b.recover()
+}
+
+// recover probes the gateway with an exponential backoff until it succeeds,
+// then closes the circuit and flushes the parked registrations.
+func (b *circuitBreaker) recover() {
+	backoff := b.minBackoff
+	for {
+		time.Sleep(backoff)
+		err := b.probe()
+		if err == nil {
+			break
+		}
+		backoff *= 2
+		if backoff > b.maxBackoff {
+			backoff = b.maxBackoff
+		}
+		log.Warnln("APNS gateway still unavailable, retrying in", backoff, ":", err)
+	}
+
+	b.mutex.Lock()
+	parked := b.parked
+	b.parked = make(map[database.Registration]time.Time)
+	b.failures = 0
+	b.open = false
+	b.mutex.Unlock()
+
+	log.Infoln("APNS circuit closed, sending", len(parked), "catch-up notifications")
+	for registration := range parked {
+		b.flush(registration)
+	}
+}
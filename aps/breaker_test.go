@@ -0,0 +1,86 @@
+package aps
+
+import (
+	"errors"
+	"github.com/st3fan/dovecot-xaps-daemon/database"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker_OpensAfterThreshold(t *testing.T) {
+	b := newCircuitBreaker(3, time.Hour, time.Hour)
+	b.probe = func() error { return errors.New("unreachable") }
+
+	b.failure(errors.New("timeout"))
+	b.failure(errors.New("timeout"))
+	if !b.allow() {
+		t.Error("circuit opened before the threshold was reached")
+	}
+
+	b.success()
+	b.failure(errors.New("timeout"))
+	b.failure(errors.New("timeout"))
+	if !b.allow() {
+		t.Error("success did not reset the failure counter")
+	}
+
+	b.failure(errors.New("timeout"))
+	if b.allow() {
+		t.Error("circuit did not open after the threshold was reached")
+	}
+}
+
+func TestCircuitBreaker_CatchUpOncePerRegistration(t *testing.T) {
+	var mutex sync.Mutex
+	var probes int
+	flushed := make(map[database.Registration]int)
+	done := make(chan struct{})
+
+	b := newCircuitBreaker(1, time.Millisecond, 4*time.Millisecond)
+	b.probe = func() error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		probes++
+		if probes < 3 {
+			return errors.New("unreachable")
+		}
+		return nil
+	}
+	b.flush = func(registration database.Registration) {
+		mutex.Lock()
+		flushed[registration]++
+		if len(flushed) == 2 {
+			close(done)
+		}
+		mutex.Unlock()
+	}
+
+	alice := database.Registration{DeviceToken: "alicetoken", AccountId: "aliceaccount"}
+	bob := database.Registration{DeviceToken: "bobtoken", AccountId: "bobaccount"}
+
+	// park before tripping so nothing can be flushed before all are parked
+	b.park(alice)
+	b.park(alice)
+	b.park(bob)
+	b.park(alice)
+	b.trip(errors.New("shutdown"))
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("parked registrations were not flushed")
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if probes != 3 {
+		t.Error("probes != 3:", probes)
+	}
+	if flushed[alice] != 1 || flushed[bob] != 1 {
+		t.Error("expected exactly one catch-up per registration:", flushed)
+	}
+	if b.parkedCount() != 0 {
+		t.Error("parked registrations were not cleared")
+	}
+}
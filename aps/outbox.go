@@ -0,0 +1,82 @@
+package aps
+
+import (
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/st3fan/dovecot-xaps-daemon/database"
+	"github.com/timehop/apns"
+	"time"
+)
+
+var errOutboxFull = errors.New("too many notifications waiting for the APNS connection")
+var errSendTimeout = errors.New("timeout while waiting for the APNS connection")
+
+type outgoing struct {
+	registration database.Registration
+	notification apns.Notification
+	logger       *log.Entry
+}
+
+// outbox hands notifications to the APNS client one at a time. The client
+// only accepts a notification while it is connected to the gateway and that
+// cannot be cancelled, so a single goroutine waits for it and the rest of
+// the notifications wait in a bounded queue. When the client takes too long
+// the circuit opens and the queued notifications are parked. A notification
+// is therefore either sent or parked, never both.
+type outbox struct {
+	queue   chan outgoing
+	timeout time.Duration
+	send    func(apns.Notification) error
+	breaker *circuitBreaker
+}
+
+func newOutbox(size int, timeout time.Duration, send func(apns.Notification) error, breaker *circuitBreaker) *outbox {
+	return &outbox{
+		queue:   make(chan outgoing, size),
+		timeout: timeout,
+		send:    send,
+		breaker: breaker,
+	}
+}
+
+// push queues the notification, or parks it if the queue is full.
+func (o *outbox) push(registration database.Registration, notification apns.Notification, logger *log.Entry) {
+	select {
+	case o.queue <- outgoing{registration: registration, notification: notification, logger: logger}:
+	default:
+		logger.Errorln("Could not send notification to", registration.AccountId, "/", registration.DeviceToken, ":", errOutboxFull)
+		o.breaker.park(registration)
+		o.breaker.failure(errOutboxFull)
+	}
+}
+
+// run sends the queued notifications until the queue is closed.
+func (o *outbox) run() {
+	for out := range o.queue {
+		timer := time.AfterFunc(o.timeout, o.stuck)
+		err := o.send(out.notification)
+		timer.Stop()
+		if err != nil {
+			out.logger.Errorln("Could not send notification to", out.registration.AccountId, "/", out.registration.DeviceToken, ":", err)
+			o.breaker.park(out.registration)
+			o.breaker.failure(err)
+			continue
+		}
+		o.breaker.success()
+	}
+}
+
+// stuck opens the circuit because the client did not accept a notification
+// in time, and parks the queued ones. The notification the client is waiting
+// with is sent once it reconnects.
+func (o *outbox) stuck() {
+	o.breaker.trip(errSendTimeout)
+	for {
+		select {
+		case out := <-o.queue:
+			o.breaker.park(out.registration)
+		default:
+			return
+		}
+	}
+}
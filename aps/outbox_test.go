@@ -0,0 +1,74 @@
+package aps
+
+import (
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/st3fan/dovecot-xaps-daemon/database"
+	"github.com/timehop/apns"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOutbox_SentOrParked(t *testing.T) {
+	b := newCircuitBreaker(3, time.Hour, time.Hour)
+	b.probe = func() error { return errors.New("unreachable") }
+
+	// the client accepts nothing until it is released
+	var mutex sync.Mutex
+	var sent []string
+	release := make(chan struct{})
+	o := newOutbox(8, 20*time.Millisecond, func(notification apns.Notification) error {
+		<-release
+		mutex.Lock()
+		sent = append(sent, notification.DeviceToken)
+		mutex.Unlock()
+		return nil
+	}, b)
+	go o.run()
+	defer close(o.queue)
+
+	logger := log.NewEntry(log.StandardLogger())
+	for _, token := range []string{"first", "second", "third"} {
+		notification := apns.NewNotification()
+		notification.DeviceToken = token
+		o.push(database.Registration{DeviceToken: token, AccountId: "account"}, notification, logger)
+	}
+
+	for i := 0; b.allow(); i++ {
+		if i == 100 {
+			t.Fatal("circuit did not open while the client was stuck")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	b.mutex.Lock()
+	_, firstParked := b.parked[database.Registration{DeviceToken: "first", AccountId: "account"}]
+	parked := len(b.parked)
+	b.mutex.Unlock()
+	if firstParked || parked != 2 {
+		t.Error("unexpected parked registrations", parked, firstParked)
+	}
+
+	// the notification the client waited with is sent once, and only that one
+	close(release)
+	time.Sleep(20 * time.Millisecond)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(sent) != 1 || sent[0] != "first" {
+		t.Error("unexpected sent notifications", sent)
+	}
+}
+
+func TestOutbox_ParksWhenFull(t *testing.T) {
+	b := newCircuitBreaker(100, time.Hour, time.Hour)
+	o := newOutbox(1, time.Hour, nil, b)
+
+	logger := log.NewEntry(log.StandardLogger())
+	o.push(database.Registration{DeviceToken: "first"}, apns.NewNotification(), logger)
+	o.push(database.Registration{DeviceToken: "second"}, apns.NewNotification(), logger)
+
+	if len(o.queue) != 1 || b.parkedCount() != 1 {
+		t.Error("full outbox did not park the notification", len(o.queue), b.parkedCount())
+	}
+}
@@ -0,0 +1,467 @@
+// Package client talks to xapsd over its UNIX socket, so that tools and tests
+// do not have to build command lines themselves.
+package client
+
+import (
+	"bufio"
+	"errors"
+	"github.com/st3fan/dovecot-xaps-daemon/protocol"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout is the time a request may take, including connecting.
+const DefaultTimeout = 10 * time.Second
+
+// the protocol version and capabilities the client asks for with HELLO
+const protocolVersion = "2"
+
+var capabilities = []string{"query", "rules", "unregister"}
+
+// Error is an ERROR reply of the daemon.
+type Error struct {
+	// the machine readable code, e.g. MISSING_ARGUMENT
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (err *Error) Error() string {
+	return err.Code + ": " + err.Message
+}
+
+// Registration is a device registered for a user, as returned by List. The
+// device token is redacted by the daemon.
+type Registration struct {
+	AccountId        string    `json:"aps-account-id"`
+	DeviceToken      string    `json:"aps-device-token"`
+	Mailboxes        []string  `json:"dovecot-mailboxes"`
+	RegistrationTime time.Time `json:"registration-time"`
+}
+
+// Status describes the health of the daemon, as returned by Status.
+type Status struct {
+	Version           string    `json:"version"`
+	Topic             string    `json:"aps-topic"`
+	CertificateExpiry time.Time `json:"certificate-expiry"`
+	// notifications waiting for their delay to pass
+	Delayed int `json:"delayed-notifications"`
+	// registrations waiting for a catch-up notification after an APNS outage
+	Parked    int  `json:"parked-notifications"`
+	Available bool `json:"apns-available"`
+}
+
+// Client is a connection to the daemon. It connects on the first request and
+// reconnects when the connection was lost, e.g. because the daemon was
+// restarted or closed the connection after it was idle for too long. A
+// Client may be used by several goroutines, requests are sent one at a time.
+type Client struct {
+	// Timeout is the time a request may take, including connecting
+	Timeout time.Duration
+
+	dial         func(timeout time.Duration) (net.Conn, error)
+	mutex        sync.Mutex
+	conn         net.Conn
+	reader       *bufio.Reader
+	capabilities map[string]bool
+	requestId    int
+}
+
+// New returns a client for the socket at socketpath.
+func New(socketpath string) *Client {
+	return NewWithDialer(func(timeout time.Duration) (net.Conn, error) {
+		return net.DialTimeout("unix", socketpath, timeout)
+	})
+}
+
+// NewWithDialer returns a client that connects with dial, e.g. to reach the
+// TLS listener of the daemon.
+func NewWithDialer(dial func(timeout time.Duration) (net.Conn, error)) *Client {
+	return &Client{Timeout: DefaultTimeout, dial: dial}
+}
+
+// Close closes the connection. The client connects again on the next
+// request.
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.disconnect()
+}
+
+// Register registers the device for the mailboxes of the user and returns
+// the aps-topic of the daemon.
+func (c *Client) Register(username, accountId, deviceToken string, mailboxes []string) (string, error) {
+	if mailboxes == nil {
+		mailboxes = []string{}
+	}
+	reply, err := c.request("REGISTER",
+		[]string{"aps-account-id", "aps-device-token", "aps-subtopic", "dovecot-username", "dovecot-mailboxes"},
+		map[string]interface{}{
+			"aps-account-id":    accountId,
+			"aps-device-token":  deviceToken,
+			"aps-subtopic":      "com.apple.mobilemail",
+			"dovecot-username":  username,
+			"dovecot-mailboxes": mailboxes,
+		})
+	return reply.message, err
+}
+
+// Notify tells the daemon about events in the mailbox of the user. Without
+// events the devices are notified right away.
+func (c *Client) Notify(username, mailbox string, events []string) error {
+	args := map[string]interface{}{
+		"dovecot-username": username,
+		"dovecot-mailbox":  mailbox,
+	}
+	if events != nil {
+		args["events"] = events
+	}
+	_, err := c.request("NOTIFY", []string{"dovecot-username", "dovecot-mailbox", "events"}, args)
+	return err
+}
+
+// Unregister removes the account of the user and returns the number of
+// removed registrations.
+func (c *Client) Unregister(username, accountId string) (int, error) {
+	return c.unregister(username, "aps-account-id", accountId)
+}
+
+// UnregisterDevice removes the device from all accounts of the user and
+// returns the number of removed registrations.
+func (c *Client) UnregisterDevice(username, deviceToken string) (int, error) {
+	return c.unregister(username, "aps-device-token", deviceToken)
+}
+
+func (c *Client) unregister(username, key, value string) (int, error) {
+	reply, err := c.request("UNREGISTER", []string{"dovecot-username", key}, map[string]interface{}{
+		"dovecot-username": username,
+		key:                value,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return reply.count()
+}
+
+// List returns the registrations of the user.
+func (c *Client) List(username string) ([]Registration, error) {
+	reply, err := c.request("LIST", []string{"dovecot-username"}, map[string]interface{}{
+		"dovecot-username": username,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	registrations := []Registration{}
+	for _, record := range reply.records("REGISTRATION") {
+		registration := Registration{
+			AccountId:   record.getString("aps-account-id"),
+			DeviceToken: record.getString("aps-device-token"),
+			Mailboxes:   record.getList("dovecot-mailboxes"),
+		}
+		registration.RegistrationTime, err = record.getTime("registration-time")
+		if err != nil {
+			return nil, err
+		}
+		registrations = append(registrations, registration)
+	}
+	return registrations, nil
+}
+
+// Status returns the health of the daemon.
+func (c *Client) Status() (Status, error) {
+	reply, err := c.request("STATUS", nil, nil)
+	if err != nil {
+		return Status{}, err
+	}
+	records := reply.records("STATUS")
+	if len(records) != 1 {
+		return Status{}, errors.New("expected a single STATUS record")
+	}
+
+	record := records[0]
+	status := Status{
+		Version:   record.getString("version"),
+		Topic:     record.getString("aps-topic"),
+		Available: record.getString("apns-state") == "available",
+	}
+	if status.CertificateExpiry, err = record.getTime("certificate-expiry"); err != nil {
+		return Status{}, err
+	}
+	if status.Delayed, err = record.getInt("delayed-notifications"); err != nil {
+		return Status{}, err
+	}
+	if status.Parked, err = record.getInt("parked-notifications"); err != nil {
+		return Status{}, err
+	}
+	return status, nil
+}
+
+// Rules returns the mailbox rules of the user.
+func (c *Client) Rules(username string) ([]string, error) {
+	return c.rules(map[string]interface{}{"dovecot-username": username})
+}
+
+// SetRules replaces the mailbox rules of the user, an empty list removes
+// them. It returns the rules that are in effect now.
+func (c *Client) SetRules(username string, rules []string) ([]string, error) {
+	if rules == nil {
+		rules = []string{}
+	}
+	return c.rules(map[string]interface{}{"dovecot-username": username, "mailbox-rules": rules})
+}
+
+func (c *Client) rules(args map[string]interface{}) ([]string, error) {
+	reply, err := c.request("RULES", []string{"dovecot-username", "mailbox-rules"}, args)
+	if err != nil {
+		return nil, err
+	}
+	records := reply.records("RULES")
+	if len(records) != 1 {
+		return nil, errors.New("expected a single RULES record")
+	}
+	return records[0].getList("mailbox-rules"), nil
+}
+
+// Capabilities returns the capabilities that were negotiated with the daemon.
+func (c *Client) Capabilities() ([]string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+	var agreed []string
+	for _, capability := range capabilities {
+		if c.capabilities[capability] {
+			agreed = append(agreed, capability)
+		}
+	}
+	return agreed, nil
+}
+
+// request sends a command and reads the reply. If a connection that was used
+// before turns out to be gone, the command is sent once more over a new one,
+// as long as the daemon cannot have carried it out already or doing it twice
+// does no harm.
+func (c *Client) request(name string, keys []string, args map[string]interface{}) (reply, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		reused := c.conn != nil
+		if err := c.connect(); err != nil {
+			return reply{}, err
+		}
+		result, err := c.exchange(name, keys, args)
+		if err == nil {
+			return result, nil
+		}
+		if _, ok := err.(*Error); ok && c.conn != nil {
+			return result, err
+		}
+		c.disconnect()
+		if !reused || attempt > 0 || isTimeout(err) || !retriable(name, err) {
+			return result, err
+		}
+	}
+}
+
+// idempotent commands can be sent again whatever happened to them before.
+var idempotent = map[string]bool{
+	"HELLO":  true,
+	"LIST":   true,
+	"STATUS": true,
+}
+
+// retriable tells whether a command that failed on a connection that was used
+// before can be sent again. A command that was not sent, or that was answered
+// by the ERROR the daemon sends before it closes an idle connection, never
+// reached the daemon. Others, like a NOTIFY whose reply got lost, might have
+// been carried out and are only sent again if they are idempotent.
+func retriable(name string, err error) bool {
+	switch err.(type) {
+	case notSentError, *Error:
+		return true
+	}
+	return idempotent[name]
+}
+
+// notSentError is returned by exchange when a command could not be written.
+type notSentError struct {
+	err error
+}
+
+func (e notSentError) Error() string {
+	return e.err.Error()
+}
+
+// connect opens a connection and negotiates the capabilities, unless the
+// client is connected already.
+func (c *Client) connect() error {
+	if c.conn != nil {
+		return nil
+	}
+
+	conn, err := c.dial(c.Timeout)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	c.reader = bufio.NewReader(conn)
+	c.capabilities = make(map[string]bool)
+
+	reply, err := c.exchange("HELLO", []string{"protocol-version", "capabilities"}, map[string]interface{}{
+		"protocol-version": protocolVersion,
+		"capabilities":     capabilities,
+	})
+	if err != nil {
+		c.disconnect()
+		return err
+	}
+	for _, record := range reply.records("HELLO") {
+		for _, capability := range record.getList("capabilities") {
+			c.capabilities[capability] = true
+		}
+	}
+	return nil
+}
+
+func (c *Client) disconnect() error {
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	c.reader = nil
+	return err
+}
+
+// exchange sends a single command and reads its reply. Every command carries
+// a request id, so that a reply that was meant for another command, like the
+// ERROR the daemon sends before it closes an idle connection, is not taken
+// for the reply to this one. Such a reply leaves the connection closed.
+func (c *Client) exchange(name string, keys []string, args map[string]interface{}) (reply, error) {
+	c.requestId++
+	requestId := strconv.Itoa(c.requestId)
+	if args == nil {
+		args = make(map[string]interface{})
+	}
+	args["request-id"] = requestId
+	line := protocol.Format(name, append(keys, "request-id"), args)
+
+	c.conn.SetDeadline(time.Now().Add(c.Timeout))
+	if _, err := io.WriteString(c.conn, line+"\n"); err != nil {
+		return reply{}, notSentError{err}
+	}
+
+	suffix := "\trequest-id=\"" + requestId + "\""
+	var result reply
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return reply{}, err
+		}
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+
+		if strings.HasPrefix(line, "* ") {
+			name, args, err := protocol.Parse(line[2:])
+			if err != nil {
+				return reply{}, err
+			}
+			result.recs = append(result.recs, record{name: name, args: args})
+			continue
+		}
+
+		matched := strings.HasSuffix(line, suffix)
+		line = strings.TrimSuffix(line, suffix)
+		switch {
+		case line == "OK" || strings.HasPrefix(line, "OK "):
+			if !matched {
+				return reply{}, errors.New("reply for another request: " + line)
+			}
+			result.message = strings.TrimPrefix(strings.TrimPrefix(line, "OK"), " ")
+			return result, nil
+		case strings.HasPrefix(line, "ERROR "):
+			codeAndMessage := strings.SplitN(strings.TrimPrefix(line, "ERROR "), " ", 2)
+			err := &Error{Code: codeAndMessage[0]}
+			if len(codeAndMessage) == 2 {
+				err.Message = codeAndMessage[1]
+			}
+			if !matched {
+				c.disconnect()
+			}
+			return reply{}, err
+		default:
+			return reply{}, errors.New("unexpected reply: " + line)
+		}
+	}
+}
+
+func isTimeout(err error) bool {
+	if notSent, ok := err.(notSentError); ok {
+		err = notSent.err
+	}
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// reply is an OK reply with the records that came before it.
+type reply struct {
+	recs    []record
+	message string
+}
+
+func (r reply) records(name string) []record {
+	var records []record
+	for _, record := range r.recs {
+		if record.name == name {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+func (r reply) count() (int, error) {
+	count, err := strconv.Atoi(r.message)
+	if err != nil {
+		return 0, errors.New("expected a number in reply: " + r.message)
+	}
+	return count, nil
+}
+
+// record is a "* NAME key=value" line of a reply.
+type record struct {
+	name string
+	args map[string]interface{}
+}
+
+func (r record) getString(key string) string {
+	value, _ := r.args[key].(string)
+	return value
+}
+
+func (r record) getList(key string) []string {
+	value, _ := r.args[key].([]string)
+	return value
+}
+
+func (r record) getInt(key string) (int, error) {
+	value, err := strconv.Atoi(r.getString(key))
+	if err != nil {
+		return 0, errors.New("expected a number in " + key + ": " + r.getString(key))
+	}
+	return value, nil
+}
+
+// getTime parses an RFC 3339 time, an empty value is the zero time.
+func (r record) getTime(key string) (time.Time, error) {
+	if r.getString(key) == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, r.getString(key))
+}
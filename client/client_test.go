@@ -0,0 +1,234 @@
+package client
+
+import (
+	"bufio"
+	"github.com/st3fan/dovecot-xaps-daemon/database"
+	"github.com/st3fan/dovecot-xaps-daemon/protocol"
+	"github.com/st3fan/dovecot-xaps-daemon/socket"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+const idleTimeout = 200 * time.Millisecond
+
+var socketpath string
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "xapsd_client_test")
+	if err != nil {
+		panic(err)
+	}
+	db, err := database.NewDatabase(filepath.Join(dir, "database.json"))
+	if err != nil {
+		panic(err)
+	}
+
+	socketpath = filepath.Join(dir, "xapsd.sock")
+	socket.Version = "test"
+	socket.ConnectionLimits.IdleTimeout = idleTimeout
+	go socket.NewSocket(socketpath, socket.Permissions{Mode: 0700}, db, "com.apple.mail.XServer.test")
+	for i := 0; ; i++ {
+		if _, err := os.Stat(socketpath); err == nil {
+			break
+		}
+		if i == 100 {
+			panic("socket was not created")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestClient_RegisterListUnregister(t *testing.T) {
+	c := New(socketpath)
+	defer c.Close()
+
+	// everything that has to be escaped
+	username := "a\"b\tc\nd\\e"
+	mailboxes := []string{"INBOX", "Notes, \"old\""}
+
+	topic, err := c.Register(username, "account1", "0123456789abcdef", mailboxes)
+	if err != nil || topic != "com.apple.mail.XServer.test" {
+		t.Fatal("Cannot register", topic, err)
+	}
+
+	registrations, err := c.List(username)
+	if err != nil {
+		t.Fatal("Cannot list", err)
+	}
+	if len(registrations) != 1 {
+		t.Fatal("len(registrations) != 1", registrations)
+	}
+	registration := registrations[0]
+	if registration.AccountId != "account1" || registration.DeviceToken != "0123...cdef" ||
+		!reflect.DeepEqual(registration.Mailboxes, mailboxes) || registration.RegistrationTime.IsZero() {
+		t.Error("unexpected registration", registration)
+	}
+
+	// nobody registered for Trash, so this does not reach APNS
+	if err := c.Notify(username, "Trash", []string{"MessageNew"}); err != nil {
+		t.Error("Cannot notify", err)
+	}
+
+	removed, err := c.Unregister(username, "account1")
+	if err != nil || removed != 1 {
+		t.Error("Cannot unregister", removed, err)
+	}
+	removed, err = c.UnregisterDevice(username, "0123456789abcdef")
+	if err != nil || removed != 0 {
+		t.Error("Unregistered a device twice", removed, err)
+	}
+}
+
+func TestClient_Errors(t *testing.T) {
+	c := New(socketpath)
+	defer c.Close()
+
+	_, err := c.Register("", "account1", "token", nil)
+	if err, ok := err.(*Error); !ok || err.Code != "INVALID_ARGUMENT" {
+		t.Error("expected INVALID_ARGUMENT", err)
+	}
+
+	// the connection can still be used after an ERROR
+	if _, err := c.List("nobody"); err != nil {
+		t.Error("Cannot list after an error", err)
+	}
+}
+
+func TestClient_StatusAndRules(t *testing.T) {
+	c := New(socketpath)
+	defer c.Close()
+
+	capabilities, err := c.Capabilities()
+	if err != nil || !reflect.DeepEqual(capabilities, []string{"query", "rules", "unregister"}) {
+		t.Error("unexpected capabilities", capabilities, err)
+	}
+
+	status, err := c.Status()
+	if err != nil {
+		t.Fatal("Cannot get status", err)
+	}
+	if status.Version != "test" || !status.Available {
+		t.Error("unexpected status", status)
+	}
+
+	rules, err := c.SetRules("stefan", []string{"Junk=ignore", "Support=immediate"})
+	if err != nil || !reflect.DeepEqual(rules, []string{"Junk=ignore", "Support=immediate"}) {
+		t.Error("Cannot set rules", rules, err)
+	}
+	if rules, err = c.Rules("stefan"); err != nil || len(rules) != 2 {
+		t.Error("Cannot get rules", rules, err)
+	}
+	if rules, err = c.SetRules("stefan", nil); err != nil || len(rules) != 0 {
+		t.Error("Cannot remove rules", rules, err)
+	}
+}
+
+func TestClient_Reconnect(t *testing.T) {
+	c := New(socketpath)
+	defer c.Close()
+
+	if _, err := c.Status(); err != nil {
+		t.Fatal("Cannot get status", err)
+	}
+
+	// the daemon closes the idle connection
+	time.Sleep(3 * idleTimeout)
+	if _, err := c.Status(); err != nil {
+		t.Error("Cannot get status after the connection was closed by the daemon", err)
+	}
+
+	// commands that are not idempotent are sent again too, the daemon
+	// closed the connection before it read them
+	time.Sleep(3 * idleTimeout)
+	if err := c.Notify("nobody", "INBOX", []string{"MessageNew"}); err != nil {
+		t.Error("Cannot notify after the connection was closed by the daemon", err)
+	}
+
+	c.Close()
+	if _, err := c.Status(); err != nil {
+		t.Error("Cannot get status after the connection was closed", err)
+	}
+}
+
+func TestClient_LostReplyIsNotSentAgain(t *testing.T) {
+	// a daemon that carries out every command but loses the connection
+	// before it replies to a NOTIFY
+	var mutex sync.Mutex
+	received := map[string]int{}
+	c := NewWithDialer(func(timeout time.Duration) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			reader := bufio.NewReader(server)
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				name, args, _ := protocol.Parse(line[:len(line)-1])
+				mutex.Lock()
+				received[name]++
+				mutex.Unlock()
+				if name == "NOTIFY" {
+					return
+				}
+				server.Write([]byte("OK \trequest-id=" + protocol.Quote(args["request-id"].(string)) + "\n"))
+			}
+		}()
+		return client, nil
+	})
+	defer c.Close()
+
+	if _, err := c.List("stefan"); err != nil {
+		t.Fatal("Cannot list registrations", err)
+	}
+	if err := c.Notify("stefan", "INBOX", []string{"MessageNew"}); err == nil {
+		t.Error("lost reply to NOTIFY was not reported")
+	}
+	if _, err := c.List("stefan"); err != nil {
+		t.Error("Cannot list registrations after a lost reply", err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if received["NOTIFY"] != 1 || received["LIST"] != 2 {
+		t.Error("unexpected commands received", received)
+	}
+}
+
+func TestClient_Timeout(t *testing.T) {
+	var server net.Conn
+	c := NewWithDialer(func(timeout time.Duration) (net.Conn, error) {
+		var client net.Conn
+		client, server = net.Pipe()
+		return client, nil
+	})
+	c.Timeout = 100 * time.Millisecond
+
+	start := time.Now()
+	_, err := c.Status()
+	if err == nil || !isTimeout(err) {
+		t.Error("expected a timeout", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("request did not time out in time")
+	}
+	server.Close()
+}
+
+func TestClient_UnreachableDaemon(t *testing.T) {
+	c := New(filepath.Join(filepath.Dir(socketpath), "missing.sock"))
+	if _, err := c.Status(); err == nil {
+		t.Error("expected an error for a missing socket")
+	}
+}
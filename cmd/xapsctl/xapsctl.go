@@ -0,0 +1,265 @@
+// xapsctl talks to a running xapsd over its socket, so that operators can
+// register test devices, send notifications and look at the state of the
+// daemon without building command lines by hand.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/st3fan/dovecot-xaps-daemon/client"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `Usage: xapsctl [options] <command> [arguments]
+
+Commands:
+  register <username> <account-id> <device-token> [mailbox...]
+        register a device for the mailboxes of the user, INBOX if none are given
+  notify <username> <mailbox> [event...]
+        notify the devices of the user about events in the mailbox
+  list <username>
+        list the registrations of the user
+  unregister [-device] <username> <account-id|device-token>
+        remove an account of the user, or with -device a device from all accounts
+  rules <username> [-clear | rule...]
+        show, replace or remove the mailbox rules of the user
+  status
+        show the state of the daemon
+
+Options:
+`
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run executes the command line and returns the exit code.
+func run(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("xapsctl", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	socketpath := flags.String("socket", "/var/run/xapsd/xapsd.sock", "path to the socket of the daemon")
+	jsonOutput := flags.Bool("json", false, "print results and errors as JSON")
+	timeout := flags.Duration("timeout", client.DefaultTimeout, "time a request may take")
+	flags.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	c := client.New(*socketpath)
+	c.Timeout = *timeout
+	defer c.Close()
+
+	out := &output{stdout: stdout, stderr: stderr, json: *jsonOutput}
+	command, commandArgs := flags.Arg(0), flags.Args()[1:]
+	switch command {
+	case "register":
+		return register(c, out, commandArgs)
+	case "notify":
+		return notify(c, out, commandArgs)
+	case "list":
+		return list(c, out, commandArgs)
+	case "unregister":
+		return unregister(c, out, commandArgs)
+	case "rules":
+		return rules(c, out, commandArgs)
+	case "status":
+		return status(c, out, commandArgs)
+	}
+	fmt.Fprintln(stderr, "xapsctl: unknown command", command)
+	flags.Usage()
+	return 2
+}
+
+// output prints results either for humans or as JSON.
+type output struct {
+	stdout io.Writer
+	stderr io.Writer
+	json   bool
+}
+
+// result prints v as JSON or calls human to print it.
+func (out *output) result(v interface{}, human func(w io.Writer)) int {
+	if out.json {
+		encoder := json.NewEncoder(out.stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(v)
+		return 0
+	}
+	human(out.stdout)
+	return 0
+}
+
+// error prints err and returns the exit code for it.
+func (out *output) error(err error) int {
+	if out.json {
+		reply, ok := err.(*client.Error)
+		if !ok {
+			reply = &client.Error{Code: "CLIENT_ERROR", Message: err.Error()}
+		}
+		json.NewEncoder(out.stderr).Encode(reply)
+		return 1
+	}
+	fmt.Fprintln(out.stderr, "xapsctl:", err)
+	return 1
+}
+
+func (out *output) usage(synopsis string) int {
+	fmt.Fprintln(out.stderr, "Usage: xapsctl", synopsis)
+	return 2
+}
+
+func register(c *client.Client, out *output, args []string) int {
+	if len(args) < 3 {
+		return out.usage("register <username> <account-id> <device-token> [mailbox...]")
+	}
+	mailboxes := args[3:]
+	if len(mailboxes) == 0 {
+		mailboxes = []string{"INBOX"}
+	}
+	topic, err := c.Register(args[0], args[1], args[2], mailboxes)
+	if err != nil {
+		return out.error(err)
+	}
+	return out.result(map[string]string{"aps-topic": topic}, func(w io.Writer) {
+		fmt.Fprintln(w, "Registered", args[1], "for", strings.Join(mailboxes, ", "), "with topic", topic)
+	})
+}
+
+func notify(c *client.Client, out *output, args []string) int {
+	if len(args) < 2 {
+		return out.usage("notify <username> <mailbox> [event...]")
+	}
+	var events []string
+	if len(args) > 2 {
+		events = args[2:]
+	}
+	if err := c.Notify(args[0], args[1], events); err != nil {
+		return out.error(err)
+	}
+	return out.result(map[string]bool{"ok": true}, func(w io.Writer) {
+		fmt.Fprintln(w, "Notified", args[0], "about", args[1])
+	})
+}
+
+func list(c *client.Client, out *output, args []string) int {
+	if len(args) != 1 {
+		return out.usage("list <username>")
+	}
+	registrations, err := c.List(args[0])
+	if err != nil {
+		return out.error(err)
+	}
+	return out.result(registrations, func(w io.Writer) {
+		if len(registrations) == 0 {
+			fmt.Fprintln(w, "No registrations for", args[0])
+			return
+		}
+		table := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(table, "ACCOUNT ID\tDEVICE TOKEN\tREGISTERED\tMAILBOXES")
+		for _, registration := range registrations {
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", registration.AccountId, registration.DeviceToken,
+				formatTime(registration.RegistrationTime), strings.Join(registration.Mailboxes, ", "))
+		}
+		table.Flush()
+	})
+}
+
+func unregister(c *client.Client, out *output, args []string) int {
+	const synopsis = "unregister [-device] <username> <account-id|device-token>"
+	flags := flag.NewFlagSet("unregister", flag.ContinueOnError)
+	flags.SetOutput(out.stderr)
+	device := flags.Bool("device", false, "remove the device from all accounts of the user")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 2 {
+		return out.usage(synopsis)
+	}
+
+	username, id := flags.Arg(0), flags.Arg(1)
+	var removed int
+	var err error
+	if *device {
+		removed, err = c.UnregisterDevice(username, id)
+	} else {
+		removed, err = c.Unregister(username, id)
+	}
+	if err != nil {
+		return out.error(err)
+	}
+	return out.result(map[string]int{"removed": removed}, func(w io.Writer) {
+		fmt.Fprintln(w, "Removed", removed, "registrations of", username)
+	})
+}
+
+func rules(c *client.Client, out *output, args []string) int {
+	if len(args) == 0 {
+		return out.usage("rules <username> [-clear | rule...]")
+	}
+
+	username := args[0]
+	var current []string
+	var err error
+	switch {
+	case len(args) == 1:
+		current, err = c.Rules(username)
+	case len(args) == 2 && args[1] == "-clear":
+		current, err = c.SetRules(username, nil)
+	default:
+		current, err = c.SetRules(username, args[1:])
+	}
+	if err != nil {
+		return out.error(err)
+	}
+	if current == nil {
+		current = []string{}
+	}
+	return out.result(map[string][]string{"mailbox-rules": current}, func(w io.Writer) {
+		if len(current) == 0 {
+			fmt.Fprintln(w, "No mailbox rules for", username)
+		}
+		for _, rule := range current {
+			fmt.Fprintln(w, rule)
+		}
+	})
+}
+
+func status(c *client.Client, out *output, args []string) int {
+	if len(args) != 0 {
+		return out.usage("status")
+	}
+	status, err := c.Status()
+	if err != nil {
+		return out.error(err)
+	}
+	return out.result(status, func(w io.Writer) {
+		apnsState := "available"
+		if !status.Available {
+			apnsState = "unavailable"
+		}
+		table := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(table, "Version:\t%s\n", status.Version)
+		fmt.Fprintf(table, "APS topic:\t%s\n", status.Topic)
+		fmt.Fprintf(table, "Certificate expiry:\t%s\n", formatTime(status.CertificateExpiry))
+		fmt.Fprintf(table, "Delayed notifications:\t%d\n", status.Delayed)
+		fmt.Fprintf(table, "Parked notifications:\t%d\n", status.Parked)
+		fmt.Fprintf(table, "APNS:\t%s\n", apnsState)
+		table.Flush()
+	})
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/st3fan/dovecot-xaps-daemon/database"
+	"github.com/st3fan/dovecot-xaps-daemon/socket"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var socketpath string
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "xapsctl_test")
+	if err != nil {
+		panic(err)
+	}
+	db, err := database.NewDatabase(filepath.Join(dir, "database.json"))
+	if err != nil {
+		panic(err)
+	}
+
+	socketpath = filepath.Join(dir, "xapsd.sock")
+	socket.Version = "test"
+	go socket.NewSocket(socketpath, socket.Permissions{Mode: 0700}, db, "com.apple.mail.XServer.test")
+	for i := 0; ; i++ {
+		if _, err := os.Stat(socketpath); err == nil {
+			break
+		}
+		if i == 100 {
+			panic("socket was not created")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func xapsctl(args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(append([]string{"-socket", socketpath}, args...), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestXapsctl_Human(t *testing.T) {
+	code, stdout, stderr := xapsctl("register", "stefan", "account1", "0123456789abcdef", "INBOX", "Notes")
+	if code != 0 || stdout != "Registered account1 for INBOX, Notes with topic com.apple.mail.XServer.test\n" {
+		t.Error("unexpected register output", code, stdout, stderr)
+	}
+
+	code, stdout, stderr = xapsctl("list", "stefan")
+	lines := strings.Split(stdout, "\n")
+	if code != 0 || len(lines) != 3 || !strings.HasPrefix(lines[0], "ACCOUNT ID") ||
+		!strings.HasPrefix(lines[1], "account1") || !strings.Contains(lines[1], "0123...cdef") ||
+		!strings.HasSuffix(lines[1], "INBOX, Notes") {
+		t.Errorf("unexpected list output %d %q %q", code, stdout, stderr)
+	}
+
+	// nobody registered for Trash, so this does not reach APNS
+	code, stdout, stderr = xapsctl("notify", "stefan", "Trash", "MessageNew")
+	if code != 0 || stdout != "Notified stefan about Trash\n" {
+		t.Error("unexpected notify output", code, stdout, stderr)
+	}
+
+	code, stdout, stderr = xapsctl("unregister", "-device", "stefan", "0123456789abcdef")
+	if code != 0 || stdout != "Removed 1 registrations of stefan\n" {
+		t.Error("unexpected unregister output", code, stdout, stderr)
+	}
+
+	code, stdout, stderr = xapsctl("status")
+	if code != 0 || !strings.Contains(stdout, "Version:") || !strings.Contains(stdout, "APNS:") {
+		t.Error("unexpected status output", code, stdout, stderr)
+	}
+
+	code, _, stderr = xapsctl("register", "", "account1", "token")
+	if code != 1 || !strings.HasPrefix(stderr, "xapsctl: INVALID_ARGUMENT: ") {
+		t.Error("unexpected error output", code, stderr)
+	}
+
+	if code, _, _ = xapsctl("list"); code != 2 {
+		t.Error("missing argument did not exit with 2", code)
+	}
+	if code, _, _ = xapsctl("frobnicate"); code != 2 {
+		t.Error("unknown command did not exit with 2", code)
+	}
+}
+
+func TestXapsctl_JSON(t *testing.T) {
+	code, stdout, stderr := xapsctl("-json", "register", "alice", "account1", "0123456789abcdef")
+	var registered map[string]string
+	if code != 0 || json.Unmarshal([]byte(stdout), &registered) != nil || registered["aps-topic"] != "com.apple.mail.XServer.test" {
+		t.Error("unexpected register output", code, stdout, stderr)
+	}
+
+	code, stdout, stderr = xapsctl("-json", "list", "alice")
+	var registrations []map[string]interface{}
+	if code != 0 || json.Unmarshal([]byte(stdout), &registrations) != nil || len(registrations) != 1 ||
+		registrations[0]["aps-account-id"] != "account1" {
+		t.Error("unexpected list output", code, stdout, stderr)
+	}
+
+	code, stdout, stderr = xapsctl("-json", "rules", "alice", "Junk=ignore")
+	var rules map[string][]string
+	if code != 0 || json.Unmarshal([]byte(stdout), &rules) != nil || len(rules["mailbox-rules"]) != 1 {
+		t.Error("unexpected rules output", code, stdout, stderr)
+	}
+	code, stdout, stderr = xapsctl("-json", "rules", "alice", "-clear")
+	if code != 0 || json.Unmarshal([]byte(stdout), &rules) != nil || len(rules["mailbox-rules"]) != 0 {
+		t.Error("unexpected rules output", code, stdout, stderr)
+	}
+
+	code, stdout, stderr = xapsctl("-json", "status")
+	var status map[string]interface{}
+	if code != 0 || json.Unmarshal([]byte(stdout), &status) != nil || status["version"] != "test" {
+		t.Error("unexpected status output", code, stdout, stderr)
+	}
+
+	code, _, stderr = xapsctl("-json", "unregister", "alice", "")
+	var failure map[string]string
+	if code != 1 || json.Unmarshal([]byte(stderr), &failure) != nil || failure["code"] != "INVALID_ARGUMENT" {
+		t.Error("unexpected error output", code, stderr)
+	}
+}
@@ -27,13 +27,35 @@ package database
 
 import (
 	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"github.com/st3fan/dovecot-xaps-daemon/mailboxname"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
 	"sync"
 	"time"
 )
 
-var dbMutex = &sync.Mutex{}
+// CompactAfter is the number of changes in the journal after which they are
+// written to a new snapshot of the database file. It has to be set before
+// NewDatabase is called.
+var CompactAfter = 1000
+
+// CompactInterval is how often the changes in the journal, and registration
+// times that were refreshed without a record, are written to a new snapshot
+// of the database file, 0 for never. It has to be set before NewDatabase is
+// called.
+var CompactInterval = time.Hour
+
+// registrationRefresh is how old the registration time of an account has to
+// be before registering it again without changes is written to the journal.
+const registrationRefresh = time.Hour
+
+// Backups is the number of previous versions of the database file that are
+// kept next to it as <filename>.1 (the newest) to <filename>.<Backups>. It
+// has to be set before NewDatabase is called.
+var Backups = 3
 
 type Registration struct {
 	DeviceToken string
@@ -46,9 +68,12 @@ type Account struct {
 	RegistrationTime time.Time
 }
 
+// ContainsMailbox checks if the account registered for the mailbox. Names
+// are compared after normalizing them, so "Inbox" matches "INBOX".
 func (account *Account) ContainsMailbox(mailbox string) bool {
+	mailbox = mailboxname.Normalize(mailbox)
 	for _, m := range account.Mailboxes {
-		if m == mailbox {
+		if mailboxname.Normalize(m) == mailbox {
 			return true
 		}
 	}
@@ -57,97 +82,474 @@ func (account *Account) ContainsMailbox(mailbox string) bool {
 
 type User struct {
 	Accounts map[string]Account
+	// mailbox rules of the user as <pattern>=<rule>, see policy.ParseMailboxRules
+	MailboxRules []string `json:",omitempty"`
 }
 
+// Database is the Store that keeps everything in memory and in a JSON file.
+// Changes are appended to a journal next to the file and written to a new
+// snapshot of the file once there are enough of them and every
+// CompactInterval.
 type Database struct {
-	filename string
-	Users    map[string]User
+	// guards Users and the files, readers share it
+	mutex        sync.RWMutex
+	filename     string
+	backups      int
+	journal      *journal
+	compactAfter int
+	// registration times were refreshed without a journal record
+	refreshed bool
+	// stops the periodic compaction
+	stop      chan struct{}
+	closeOnce sync.Once
+	Users     map[string]User
 }
 
+var _ Store = &Database{}
+
 func NewDatabase(filename string) (*Database, error) {
+	db := &Database{
+		filename:     filename,
+		backups:      Backups,
+		journal:      newJournal(filename + ".journal"),
+		compactAfter: CompactAfter,
+		stop:         make(chan struct{}),
+		Users:        make(map[string]User),
+	}
+
 	// check if file exists
 	_, err := os.Stat(filename)
 	if err != nil && os.IsNotExist(err) {
-		db := &Database{filename: filename, Users: make(map[string]User)}
 		err := db.write()
 		if err != nil {
 			return nil, err
 		}
-		return db, nil
+	} else if err := db.restore(); err != nil {
+		return nil, err
+	}
+
+	// changes since the last snapshot go into a new one right away
+	records, err := replayJournal(db.journal.filename, db.Users)
+	if err == errIncompleteRecord {
+		log.Warnln("Ignoring the last record of", db.journal.filename, ", it was not completely written")
+	} else if err != nil {
+		broken := db.journal.filename + ".broken"
+		log.Errorln("Cannot replay", db.journal.filename, "after", records, "records:", err, ", moving it to", broken)
+		if err := os.Rename(db.journal.filename, broken); err != nil {
+			return nil, err
+		}
+	}
+	if records != 0 {
+		if err := db.write(); err != nil {
+			return nil, err
+		}
+	}
+	if err := db.journal.truncate(); err != nil {
+		return nil, err
+	}
+	if CompactInterval > 0 {
+		go db.compactEvery(CompactInterval)
+	}
+	return db, nil
+}
+
+// compactEvery writes a new snapshot every interval if anything changed,
+// until the database is closed.
+func (db *Database) compactEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := db.compact(); err != nil {
+				log.Errorln("Cannot compact database journal:", err)
+			}
+		case <-db.stop:
+			return
+		}
+	}
+}
+
+// restore reads the database file or, if that is corrupt, the newest backup
+// that can be read.
+func (db *Database) restore() error {
+	err := db.read(db.filename)
+	if err == nil {
+		return nil
+	}
+	// a file we cannot read, for example because of its permissions, may be
+	// perfectly fine and must not be replaced by an older backup
+	if _, ok := err.(corruptError); !ok {
+		return err
+	}
+
+	// a crash of an older version while writing could leave a corrupt file,
+	// the newest backup that can be read replaces it
+	for i := 1; i <= db.backups; i++ {
+		backup := db.backupFilename(i)
+		if _, statErr := os.Stat(backup); statErr != nil {
+			continue
+		}
+		if backupErr := db.read(backup); backupErr != nil {
+			log.Warnln("Cannot read database backup", backup, ":", backupErr)
+			continue
+		}
+		// the corrupt file is kept aside, it must not become a backup
+		log.Errorln("Cannot read database", db.filename, ":", err, ", restoring it from", backup, "and keeping it as", db.filename+".corrupt")
+		if err := os.Rename(db.filename, db.filename+".corrupt"); err != nil {
+			return err
+		}
+		return db.write()
 	}
+	return err
+}
+
+// update runs change, which returns the users it changed, and waits until
+// their new state is in the journal. Changes made at the same time are
+// written together.
+func (db *Database) update(change func() []string) error {
+	db.mutex.Lock()
+	var seq uint64
+	for _, username := range change() {
+		record := journalRecord{Username: username}
+		if user, ok := db.Users[username]; ok {
+			record.User = &user
+		}
+		var err error
+		if seq, err = db.journal.add(record); err != nil {
+			db.mutex.Unlock()
+			return err
+		}
+	}
+	db.mutex.Unlock()
+	if seq == 0 {
+		return nil
+	}
+
+	if err := db.journal.wait(seq); err != nil {
+		// the change is still in memory, a snapshot saves it and gives
+		// us an empty journal to continue with
+		log.Errorln("Cannot write database journal:", err, ", writing a snapshot instead")
+		if compactErr := db.compact(); compactErr != nil {
+			log.Errorln("Cannot compact database journal:", compactErr)
+			return err
+		}
+		return nil
+	}
+	if db.compactAfter > 0 && db.journal.count() >= db.compactAfter {
+		if err := db.compact(); err != nil {
+			log.Errorln("Cannot compact database journal:", err)
+		}
+	}
+	return nil
+}
+
+// compact writes a new snapshot of the database file and empties the
+// journal, unless nothing changed since the last snapshot.
+func (db *Database) compact() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if db.journal.count() == 0 && !db.refreshed {
+		return nil
+	}
+	// a journal that cannot be written is replaced by the snapshot
+	if err := db.journal.sync(); err != nil {
+		log.Warnln("Cannot write database journal:", err)
+	}
+	if err := db.write(); err != nil {
+		return err
+	}
+	db.refreshed = false
+	return db.journal.truncate()
+}
 
+// read replaces the users with those in the file. An empty file holds no
+// users.
+func (db *Database) read(filename string) error {
 	data, err := ioutil.ReadFile(filename)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	db := Database{filename: filename, Users: make(map[string]User)}
+	db.Users = make(map[string]User)
 	if len(data) != 0 {
-		err := json.Unmarshal(data, &db)
-		if err != nil {
-			return nil, err
+		if err := json.Unmarshal(data, db); err != nil {
+			db.Users = make(map[string]User)
+			return corruptError{err}
 		}
 	}
+	return nil
+}
+
+// corruptError is returned by read for a file that is not a valid database.
+type corruptError struct {
+	err error
+}
+
+func (e corruptError) Error() string {
+	return e.err.Error()
+}
 
-	return &db, nil
+func (db *Database) backupFilename(i int) string {
+	return db.filename + "." + strconv.Itoa(i)
 }
 
+// write replaces the database file atomically. The new content goes to a
+// temporary file that is synced and then renamed over the old file, which is
+// kept as the newest backup.
 func (db *Database) write() error {
 	data, err := json.MarshalIndent(db, "", "  ")
 	if err != nil {
 		return err
 	}
 
-	return ioutil.WriteFile(db.filename, data, 0644)
+	dir, base := filepath.Split(db.filename)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := ioutil.TempFile(dir, base+".tmp")
+	if err != nil {
+		return err
+	}
+	tempname := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tempname, 0644)
+	}
+	if err != nil {
+		os.Remove(tempname)
+		return err
+	}
+
+	db.rotateBackups()
+	if err := os.Rename(tempname, db.filename); err != nil {
+		os.Remove(tempname)
+		return err
+	}
+
+	// the rename is only durable once the directory is synced
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// rotateBackups shifts the backups by one and links the current database file
+// as the newest. The database file itself stays in place. Failures only cost
+// a backup, so they are logged and otherwise ignored.
+func (db *Database) rotateBackups() {
+	if db.backups <= 0 {
+		return
+	}
+	if _, err := os.Stat(db.filename); err != nil {
+		return
+	}
+	for i := db.backups; i > 1; i-- {
+		if err := os.Rename(db.backupFilename(i-1), db.backupFilename(i)); err != nil && !os.IsNotExist(err) {
+			log.Warnln("Cannot rotate database backup:", err)
+		}
+	}
+	newest := db.backupFilename(1)
+	os.Remove(newest)
+	if err := os.Link(db.filename, newest); err != nil {
+		log.Warnln("Cannot create database backup:", err)
+	}
 }
 
+// AddRegistration creates or replaces the account of the user. Registering
+// the same device token and mailboxes again only refreshes the registration
+// time.
 func (db *Database) AddRegistration(username, accountId, deviceToken string, mailboxes []string) error {
 	//  mutual write access to database issue #16 xaps-plugin
-	dbMutex.Lock()
+	return db.update(func() []string {
+		// Ensure the User exists
+		if _, ok := db.Users[username]; !ok {
+			db.Users[username] = User{Accounts: make(map[string]Account)}
+		}
 
-	// Ensure the User exists
-	if _, ok := db.Users[username]; !ok {
-		db.Users[username] = User{Accounts: make(map[string]Account)}
-	}
+		// iOS registers again on every IMAP connection. The registration
+		// time is refreshed, so that feedback from before it does not remove
+		// the device, but it is only written to the journal once the previous
+		// one is old; a snapshot writes it anyway.
+		if account, ok := db.Users[username].Accounts[accountId]; ok &&
+			account.DeviceToken == deviceToken && equalMailboxes(account.Mailboxes, mailboxes) {
+			previous := account.RegistrationTime
+			account.RegistrationTime = time.Now()
+			db.Users[username].Accounts[accountId] = account
+			if account.RegistrationTime.Sub(previous) < registrationRefresh {
+				db.refreshed = true
+				return nil
+			}
+			return []string{username}
+		}
+
+		// Set or update the Registration
+		db.Users[username].Accounts[accountId] =
+			Account{
+				DeviceToken:      deviceToken,
+				Mailboxes:        append([]string(nil), mailboxes...),
+				RegistrationTime: time.Now(),
+			}
+		return []string{username}
+	})
+}
 
-	// Ensure the Account exists
-	if _, ok := db.Users[username].Accounts[accountId]; !ok {
-		db.Users[username].Accounts[accountId] = Account{}
+func equalMailboxes(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
 	}
+	return true
+}
+
+// DeleteIfExistRegistration removes the accounts with the device token that
+// were registered before the device was reported as gone. The removed
+// registrations are returned, also when they could not be written to disk.
+func (db *Database) DeleteIfExistRegistration(deviceToken string, deletedTimestamp time.Time) ([]Registration, error) {
+	var removed []Registration
+	err := db.update(func() []string {
+		var changed []string
+		for username, user := range db.Users {
+			found := false
+			for accountId, account := range user.Accounts {
+				if account.DeviceToken == deviceToken &&
+					!account.RegistrationTime.IsZero() && account.RegistrationTime.Before(deletedTimestamp) {
+					delete(user.Accounts, accountId)
+					removed = append(removed, Registration{DeviceToken: deviceToken, AccountId: accountId})
+					found = true
+				}
+			}
+			if !found {
+				continue
+			}
+			if len(user.Accounts) == 0 && len(user.MailboxRules) == 0 {
+				delete(db.Users, username)
+			}
+			changed = append(changed, username)
+		}
+		return changed
+	})
+	return removed, err
+}
 
-	// Set or update the Registration
-	db.Users[username].Accounts[accountId] =
-		Account{
-			DeviceToken:      deviceToken,
-			Mailboxes:        mailboxes,
-			RegistrationTime: time.Now(),
+// DeleteRegistrations removes the accounts of the user that match the given
+// account id or, if that is empty, the given device token. The removed
+// registrations are returned.
+func (db *Database) DeleteRegistrations(username, accountId, deviceToken string) ([]Registration, error) {
+	var removed []Registration
+	err := db.update(func() []string {
+		user, ok := db.Users[username]
+		if !ok {
+			return nil
+		}
+		for id, account := range user.Accounts {
+			if (accountId != "" && id == accountId) || (accountId == "" && account.DeviceToken == deviceToken) {
+				delete(user.Accounts, id)
+				removed = append(removed, Registration{DeviceToken: account.DeviceToken, AccountId: id})
+			}
+		}
+		if len(removed) == 0 {
+			return nil
 		}
+		if len(user.Accounts) == 0 && len(user.MailboxRules) == 0 {
+			delete(db.Users, username)
+		}
+		return []string{username}
+	})
+	return removed, err
+}
 
-	err := db.write()
+// SetMailboxRules replaces the mailbox rules of the user. An empty list
+// removes them.
+func (db *Database) SetMailboxRules(username string, rules []string) error {
+	return db.update(func() []string {
+		user, ok := db.Users[username]
+		if !ok {
+			if len(rules) == 0 {
+				return nil
+			}
+			user = User{Accounts: make(map[string]Account)}
+		}
+		if len(rules) == 0 {
+			user.MailboxRules = nil
+		} else {
+			user.MailboxRules = append([]string(nil), rules...)
+		}
+		if len(user.Accounts) == 0 && len(user.MailboxRules) == 0 {
+			delete(db.Users, username)
+		} else {
+			db.Users[username] = user
+		}
+		return []string{username}
+	})
+}
 
-	// release mutex
-	dbMutex.Unlock()
-	return err
+// MailboxRules returns a copy of the mailbox rules of the user.
+func (db *Database) MailboxRules(username string) ([]string, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	return append([]string(nil), db.Users[username].MailboxRules...), nil
 }
 
-func (db *Database) DeleteIfExistRegistration(deviceToken string, deletedTimestamp time.Time) bool {
-	for _, user := range db.Users {
+// ListAccounts returns a copy of all accounts of the user, keyed by account id.
+func (db *Database) ListAccounts(username string) (map[string]Account, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	accounts := make(map[string]Account)
+	if user, ok := db.Users[username]; ok {
 		for accountId, account := range user.Accounts {
-			if account.DeviceToken == deviceToken {
-				if !account.RegistrationTime.IsZero() && account.RegistrationTime.Before(deletedTimestamp) {
-					dbMutex.Lock()
-					delete(user.Accounts, accountId)
-					dbMutex.Unlock()
-					return true
-				} else {
-					return false
+			account.Mailboxes = append([]string(nil), account.Mailboxes...)
+			accounts[accountId] = account
+		}
+	}
+	return accounts, nil
+}
+
+func (db *Database) Iterate(fn func(username, accountId string, account Account) error) error {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	for username, user := range db.Users {
+		for accountId, account := range user.Accounts {
+			account.Mailboxes = append([]string(nil), account.Mailboxes...)
+			if err := fn(username, accountId, account); err != nil {
+				if err == ErrStopIteration {
+					return nil
 				}
+				return err
 			}
 		}
 	}
-	return false
+	return nil
+}
+
+// Close stops the periodic compaction and writes what changed since the last
+// snapshot to a new one.
+func (db *Database) Close() error {
+	db.closeOnce.Do(func() { close(db.stop) })
+	if err := db.compact(); err != nil {
+		return err
+	}
+	return db.journal.close()
 }
 
 func (db *Database) FindRegistrations(username, mailbox string) ([]Registration, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
 	var registrations []Registration
 	if user, ok := db.Users[username]; ok {
 		for accountId, account := range user.Accounts {
@@ -28,6 +28,10 @@ package database
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -60,7 +64,7 @@ func TestDatabase_AddRegistration(t *testing.T) {
 	if err != nil {
 		t.Error("Can't create temporary file", err)
 	}
-	defer os.Remove(f.Name())
+	defer removeDatabase(f.Name())
 
 	db, err := NewDatabase(f.Name())
 	if err != nil {
@@ -108,6 +112,15 @@ func TestDatabase_FindRegistrations(t *testing.T) {
 		t.Error(`len(registrations) != 2`)
 	}
 
+	registrations, err = db.FindRegistrations("stefan", "INBOX")
+	if err != nil {
+		t.Error("Cannot findRegistrations:", err)
+	}
+
+	if len(registrations) != 2 {
+		t.Error(`len(registrations) != 2`)
+	}
+
 	registrations, err = db.FindRegistrations("stefan", "Ham")
 	if err != nil {
 		t.Error("Cannot findRegistrations:", err)
@@ -144,18 +157,371 @@ func TestDatabase_AccountContainsMailbox(t *testing.T) {
 }
 
 func TestDatabase_DeleteIfExistRegistration(t *testing.T) {
+	f, err := ioutil.TempFile("/tmp", "database_test_Test_deleteIfExistRegistration")
+	if err != nil {
+		t.Error("Can't create temporary file", err)
+	}
+	defer removeDatabase(f.Name())
+
+	data, err := ioutil.ReadFile("testdata/database.json")
+	if err != nil {
+		t.Fatal("Cannot read testdata/database.json", err)
+	}
+	f.Write(data)
+	f.Close()
+
+	db, err := NewDatabase(f.Name())
+	if err != nil {
+		t.Error("Cannot open database", err)
+	}
+
+	removed, err := db.DeleteIfExistRegistration("alicedevicetoken1", time.Now())
+	if err != nil || len(removed) != 1 {
+		t.Error("Device token could not be removed", removed, err)
+	}
+
+	removed, err = db.DeleteIfExistRegistration("alicedevicetoken1", time.Now())
+	if err != nil || len(removed) != 0 {
+		t.Error("Not existend device token has been *successfully* deleted???", removed, err)
+	}
+
+	db, err = NewDatabase(f.Name())
+	if err != nil {
+		t.Error("Cannot open database", err)
+	}
+	if _, ok := db.Users["alice"]; ok {
+		t.Error(`Users["alice"] is back after reopening`)
+	}
+}
+
+func TestDatabase_DeleteRegistrations(t *testing.T) {
+	f, err := ioutil.TempFile("/tmp", "database_test_Test_deleteRegistrations")
+	if err != nil {
+		t.Error("Can't create temporary file", err)
+	}
+	defer removeDatabase(f.Name())
+
+	db, err := NewDatabase(f.Name())
+	if err != nil {
+		t.Error("Cannot open database", err)
+	}
+
+	db.AddRegistration("test@example.com", "testaccountid1", "testtoken1", []string{"Inbox"})
+	db.AddRegistration("test@example.com", "testaccountid2", "testtoken2", []string{"Inbox"})
+	db.AddRegistration("test@example.com", "testaccountid3", "testtoken2", []string{"Inbox"})
+
+	removed, err := db.DeleteRegistrations("test@example.com", "testaccountid1", "")
+	if err != nil {
+		t.Error("Cannot deleteRegistrations:", err)
+	}
+	if len(removed) != 1 || removed[0].AccountId != "testaccountid1" || removed[0].DeviceToken != "testtoken1" {
+		t.Error("Unexpected removed registrations by account id", removed)
+	}
+
+	removed, err = db.DeleteRegistrations("test@example.com", "", "testtoken2")
+	if err != nil {
+		t.Error("Cannot deleteRegistrations:", err)
+	}
+	if len(removed) != 2 {
+		t.Error("len(removed) != 2", removed)
+	}
+
+	removed, err = db.DeleteRegistrations("doesnotexist", "", "testtoken2")
+	if err != nil || len(removed) != 0 {
+		t.Error("Removed registrations of an unknown user", removed, err)
+	}
+
+	db, err = NewDatabase(f.Name())
+	if err != nil {
+		t.Error("Cannot open database", err)
+	}
+
+	if _, ok := db.Users["test@example.com"]; ok {
+		t.Error(`Users["test@example.com"] still exists after removing all accounts`)
+	}
+}
+
+func TestDatabase_ListAccounts(t *testing.T) {
 	db, err := NewDatabase("testdata/database.json")
 	if err != nil {
 		t.Error("Cannot open database testdata/database.json", err)
 	}
 
-	success := db.DeleteIfExistRegistration("alicedevicetoken1", time.Now())
-	if !success {
-		t.Error("Device token could not be removed", err)
+	accounts, err := db.ListAccounts("stefan")
+	if err != nil {
+		t.Error("Cannot listAccounts:", err)
+	}
+	if len(accounts) != 2 {
+		t.Error("len(accounts) != 2")
+	}
+	if accounts["stefanaccountid2"].DeviceToken != "stefandevicetoken2" {
+		t.Error(`accounts["stefanaccountid2"].DeviceToken != "stefandevicetoken2"`)
+	}
+
+	accounts["stefanaccountid2"].Mailboxes[0] = "Changed"
+	if db.Users["stefan"].Accounts["stefanaccountid2"].Mailboxes[0] != "Inbox" {
+		t.Error("ListAccounts does not return a copy of the mailboxes")
 	}
 
-	success = db.DeleteIfExistRegistration("alicedevicetoken1", time.Now())
-	if success {
-		t.Error("Not existend device token has been *successfully* deleted???", err)
+	if accounts, _ := db.ListAccounts("doesnotexist"); len(accounts) != 0 {
+		t.Error(`len(db.ListAccounts("doesnotexist")) != 0`)
+	}
+}
+
+func TestDatabase_SetMailboxRules(t *testing.T) {
+	f, err := ioutil.TempFile("/tmp", "database_test_Test_setMailboxRules")
+	if err != nil {
+		t.Error("Can't create temporary file", err)
+	}
+	defer removeDatabase(f.Name())
+
+	db, err := NewDatabase(f.Name())
+	if err != nil {
+		t.Error("Cannot open database", err)
+	}
+
+	db.AddRegistration("test@example.com", "testaccountid1", "testtoken1", []string{"Inbox"})
+	err = db.SetMailboxRules("test@example.com", []string{"Junk=ignore", "Support=immediate"})
+	if err != nil {
+		t.Error("Cannot setMailboxRules:", err)
+	}
+	err = db.SetMailboxRules("rulesonly@example.com", []string{"Trash=ignore"})
+	if err != nil {
+		t.Error("Cannot setMailboxRules:", err)
+	}
+
+	db, err = NewDatabase(f.Name())
+	if err != nil {
+		t.Error("Cannot open database", err)
+	}
+
+	rules, err := db.MailboxRules("test@example.com")
+	if err != nil {
+		t.Error("Cannot get mailboxRules:", err)
+	}
+	if len(rules) != 2 || rules[0] != "Junk=ignore" || rules[1] != "Support=immediate" {
+		t.Error("Unexpected mailbox rules", rules)
+	}
+	rules[0] = "Changed"
+	if db.Users["test@example.com"].MailboxRules[0] != "Junk=ignore" {
+		t.Error("MailboxRules does not return a copy of the rules")
+	}
+
+	// users without accounts are kept as long as they have rules
+	db.DeleteRegistrations("test@example.com", "testaccountid1", "")
+	if rules, _ := db.MailboxRules("test@example.com"); len(rules) != 2 {
+		t.Error("Mailbox rules were removed with the last account")
+	}
+	db.SetMailboxRules("test@example.com", nil)
+	if _, ok := db.Users["test@example.com"]; ok {
+		t.Error(`Users["test@example.com"] still exists after removing all accounts and rules`)
+	}
+
+	if rules, _ := db.MailboxRules("rulesonly@example.com"); len(rules) != 1 {
+		t.Error(`len(db.MailboxRules("rulesonly@example.com")) != 1`)
+	}
+	if rules, _ := db.MailboxRules("doesnotexist"); len(rules) != 0 {
+		t.Error(`len(db.MailboxRules("doesnotexist")) != 0`)
+	}
+}
+
+// removeDatabase removes the database file and its backups.
+func removeDatabase(filename string) {
+	backups, _ := filepath.Glob(filename + ".*")
+	for _, backup := range append(backups, filename) {
+		os.Remove(backup)
+	}
+}
+
+func TestDatabase_Backups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "database_test_Test_backups")
+	if err != nil {
+		t.Fatal("Can't create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "database.json")
+
+	// every change writes a snapshot
+	defer func(compactAfter int) { CompactAfter = compactAfter }(CompactAfter)
+	CompactAfter = 1
+
+	db, err := NewDatabase(filename)
+	if err != nil {
+		t.Fatal("Cannot open database", err)
+	}
+	for i := 1; i <= Backups+2; i++ {
+		db.AddRegistration("test@example.com", "testaccountid"+strconv.Itoa(i), "testtoken", []string{"Inbox"})
+	}
+
+	backups, _ := filepath.Glob(filename + ".[0-9]*")
+	if len(backups) != Backups {
+		t.Error("Unexpected backups of the database", backups)
+	}
+	for i := 1; i <= Backups; i++ {
+		backup, err := NewDatabase(filename + "." + strconv.Itoa(i))
+		if err != nil {
+			t.Fatal("Cannot open backup", i, err)
+		}
+		if accounts := len(backup.Users["test@example.com"].Accounts); accounts != Backups+2-i {
+			t.Error("Backup", i, "has", accounts, "accounts")
+		}
+	}
+}
+
+func TestDatabase_RestoreBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "database_test_Test_restoreBackup")
+	if err != nil {
+		t.Fatal("Can't create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "database.json")
+
+	// every change writes a snapshot
+	defer func(compactAfter int) { CompactAfter = compactAfter }(CompactAfter)
+	CompactAfter = 1
+
+	db, err := NewDatabase(filename)
+	if err != nil {
+		t.Fatal("Cannot open database", err)
+	}
+	db.AddRegistration("test@example.com", "testaccountid1", "testtoken1", []string{"Inbox"})
+	db.AddRegistration("test@example.com", "testaccountid2", "testtoken2", []string{"Inbox"})
+	db.AddRegistration("test@example.com", "testaccountid3", "testtoken3", []string{"Inbox"})
+
+	// a truncated database and a truncated newest backup
+	ioutil.WriteFile(filename, []byte(`{"Users": {"test@exa`), 0644)
+	ioutil.WriteFile(filename+".1", []byte(`{"Users": `), 0644)
+	backup2 := string(readFile(t, filename+".2"))
+	backup3 := string(readFile(t, filename+".3"))
+	if backup2 == "" || backup3 == "" {
+		t.Fatal("Missing database backups")
+	}
+
+	db, err = NewDatabase(filename)
+	if err != nil {
+		t.Fatal("Cannot open database with a corrupt file", err)
+	}
+	if accounts := db.Users["test@example.com"].Accounts; len(accounts) != 1 {
+		t.Error("Database was not restored from the second backup", accounts)
+	}
+
+	// the restored database replaced the corrupt file
+	if data, _ := ioutil.ReadFile(filename); !strings.Contains(string(data), "testaccountid1") {
+		t.Error("Corrupt database file was not replaced", string(data))
+	}
+
+	// the corrupt file was kept aside instead of pushing the good backups out
+	if data := string(readFile(t, filename+".corrupt")); data != `{"Users": {"test@exa` {
+		t.Error("Corrupt database file was not kept", data)
+	}
+	if string(readFile(t, filename+".2")) != backup2 || string(readFile(t, filename+".3")) != backup3 {
+		t.Error("Restoring the database rotated the backups")
+	}
+}
+
+func TestDatabase_CorruptWithoutBackups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "database_test_Test_corruptWithoutBackups")
+	if err != nil {
+		t.Fatal("Can't create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "database.json")
+
+	ioutil.WriteFile(filename, []byte(`{"Users": {"test@exa`), 0644)
+	if _, err := NewDatabase(filename); err == nil {
+		t.Error("Opened a corrupt database without backups")
+	}
+}
+
+func TestDatabase_UnreadableWithBackups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "database_test_Test_unreadableWithBackups")
+	if err != nil {
+		t.Fatal("Can't create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "database.json")
+
+	// a database file that cannot be read at all, next to a good backup
+	os.Mkdir(filename, 0755)
+	ioutil.WriteFile(filename+".1", []byte(`{"Users": {}}`), 0644)
+
+	if _, err := NewDatabase(filename); err == nil {
+		t.Error("Restored a backup over a database file that could not be read")
+	}
+	if info, err := os.Stat(filename); err != nil || !info.IsDir() {
+		t.Error("Database file that could not be read was replaced", err)
+	}
+	if _, err := os.Stat(filename + ".corrupt"); !os.IsNotExist(err) {
+		t.Error("Database file that could not be read was moved aside", err)
+	}
+}
+
+func TestDatabase_ConcurrentAccess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "database_test_Test_concurrentAccess")
+	if err != nil {
+		t.Fatal("Can't create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// instances must not depend on each other for their locking
+	var dbs []*Database
+	for i := 0; i < 2; i++ {
+		db, err := NewDatabase(filepath.Join(dir, "database"+strconv.Itoa(i)+".json"))
+		if err != nil {
+			t.Fatal("Cannot open database", err)
+		}
+		dbs = append(dbs, db)
+	}
+
+	const workers = 8
+	const rounds = 25
+	var wg sync.WaitGroup
+	for _, db := range dbs {
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(db *Database, w int) {
+				defer wg.Done()
+				token := "token" + strconv.Itoa(w)
+				for i := 0; i < rounds; i++ {
+					accountId := "account" + strconv.Itoa(w) + "-" + strconv.Itoa(i)
+					mailboxes := []string{"Inbox"}
+					db.AddRegistration("test@example.com", accountId, token, mailboxes)
+					// the database must not share the slice with the caller
+					mailboxes[0] = "Changed"
+					db.FindRegistrations("test@example.com", "INBOX")
+					db.ListAccounts("test@example.com")
+					db.Iterate(func(username, accountId string, account Account) error {
+						return nil
+					})
+					switch i % 3 {
+					case 0:
+						db.DeleteRegistrations("test@example.com", accountId, "")
+					case 1:
+						db.DeleteIfExistRegistration(token, time.Now())
+					}
+				}
+			}(db, w)
+		}
+	}
+	wg.Wait()
+
+	for _, db := range dbs {
+		registrations, err := db.FindRegistrations("test@example.com", "Inbox")
+		if err != nil {
+			t.Fatal("Cannot findRegistrations:", err)
+		}
+		accounts, _ := db.ListAccounts("test@example.com")
+		if len(registrations) != len(accounts) {
+			t.Error("Not all accounts are registered for Inbox", len(registrations), len(accounts))
+		}
+
+		// the file holds the same as the memory
+		reopened, err := NewDatabase(db.filename)
+		if err != nil {
+			t.Fatal("Cannot open database", err)
+		}
+		if len(reopened.Users["test@example.com"].Accounts) != len(accounts) {
+			t.Error("Database file differs from the memory", len(reopened.Users["test@example.com"].Accounts), len(accounts))
+		}
 	}
 }
@@ -0,0 +1,208 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+var errIncompleteRecord = errors.New("incomplete record at the end of the journal")
+
+// journalRecord holds the state of a user after a change, or no user if the
+// user was removed. Replaying the same record twice does no harm.
+type journalRecord struct {
+	Username string
+	User     *User `json:",omitempty"`
+}
+
+// journal appends the changes to the database to a file, one JSON record per
+// line, so that a change does not have to rewrite the whole database.
+//
+// Records are added in the order of the changes and written in batches:
+// whoever waits for a record while no write is going on writes everything
+// that was added so far with a single write and sync, the others wait for
+// that to finish. Under load many changes share one sync.
+type journal struct {
+	filename string
+
+	mutex   sync.Mutex
+	written *sync.Cond
+	file    *os.File
+	pending bytes.Buffer
+	// sequence numbers of the last added and the last written record
+	added, synced uint64
+	writing       bool
+	// a failed write stops the journal until a snapshot replaces it and it
+	// is truncated, so that no record is written after a missing one
+	err error
+	// records in the file, written or not
+	records int
+}
+
+func newJournal(filename string) *journal {
+	j := &journal{filename: filename}
+	j.written = sync.NewCond(&j.mutex)
+	return j
+}
+
+// add queues a record and returns its sequence number for wait.
+func (j *journal) add(record journalRecord) (uint64, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return 0, err
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.pending.Write(data)
+	j.pending.WriteByte('\n')
+	j.added++
+	j.records++
+	return j.added, nil
+}
+
+// wait returns once the record with the sequence number is on disk.
+func (j *journal) wait(seq uint64) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	for j.synced < seq {
+		if j.err != nil {
+			return j.err
+		}
+		if j.writing {
+			j.written.Wait()
+			continue
+		}
+
+		data := append([]byte(nil), j.pending.Bytes()...)
+		last := j.added
+		j.pending.Reset()
+		j.writing = true
+		j.mutex.Unlock()
+		err := j.write(data)
+		j.mutex.Lock()
+		j.writing = false
+		if err != nil {
+			// the file is opened again once the journal is truncated
+			j.err = err
+			if j.file != nil {
+				j.file.Close()
+				j.file = nil
+			}
+		} else {
+			j.synced = last
+		}
+		j.written.Broadcast()
+	}
+	return nil
+}
+
+// sync returns once all added records are on disk.
+func (j *journal) sync() error {
+	j.mutex.Lock()
+	added := j.added
+	j.mutex.Unlock()
+	return j.wait(added)
+}
+
+// write appends data to the file and syncs it. Only one write runs at a time.
+func (j *journal) write(data []byte) error {
+	if j.file == nil {
+		file, err := os.OpenFile(j.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		j.file = file
+	}
+	if _, err := j.file.Write(data); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// count returns the number of records in the file.
+func (j *journal) count() int {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.records
+}
+
+// truncate empties the journal once its records are in a snapshot. No
+// records may be added meanwhile.
+func (j *journal) truncate() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.pending.Reset()
+	j.synced = j.added
+	j.records = 0
+	j.err = nil
+	if j.file == nil {
+		err := os.Remove(j.filename)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// close closes the file, it is opened again when records are written.
+func (j *journal) close() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
+
+// replayJournal applies the records in the journal file to the users and
+// returns how many there were. A record that was cut off by a crash ends the
+// replay, it was never reported as written.
+func replayJournal(filename string, users map[string]User) (int, error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	records := 0
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) != 0 {
+				return records, errIncompleteRecord
+			}
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		var record journalRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return records, err
+		}
+		if record.User == nil {
+			delete(users, record.Username)
+		} else {
+			users[record.Username] = *record.User
+		}
+		records++
+	}
+}
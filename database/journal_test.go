@@ -0,0 +1,280 @@
+package database
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestDatabase(t *testing.T) (*Database, func()) {
+	dir, err := ioutil.TempDir("", "journal_test")
+	if err != nil {
+		t.Fatal("Can't create temporary directory", err)
+	}
+	db, err := NewDatabase(filepath.Join(dir, "database.json"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal("Cannot open database", err)
+	}
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func readFile(t *testing.T, filename string) []byte {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal("Cannot read", filename, err)
+	}
+	return data
+}
+
+func TestJournal_Replay(t *testing.T) {
+	db, cleanup := newTestDatabase(t)
+	defer cleanup()
+	snapshot := readFile(t, db.filename)
+
+	db.AddRegistration("test@example.com", "testaccountid1", "testtoken1", []string{"Inbox"})
+	db.AddRegistration("test@example.com", "testaccountid2", "testtoken2", []string{"Inbox"})
+	db.AddRegistration("alice@example.com", "aliceaccountid", "alicetoken", []string{"Inbox"})
+	db.DeleteRegistrations("test@example.com", "testaccountid1", "")
+	db.SetMailboxRules("test@example.com", []string{"Junk=ignore"})
+	db.DeleteIfExistRegistration("alicetoken", db.Users["alice@example.com"].Accounts["aliceaccountid"].RegistrationTime.Add(1))
+
+	// the changes only went to the journal
+	if !bytes.Equal(readFile(t, db.filename), snapshot) {
+		t.Error("Database file was written")
+	}
+	if lines := bytes.Count(readFile(t, db.journal.filename), []byte("\n")); lines != 6 {
+		t.Error("Unexpected number of journal records", lines)
+	}
+
+	reopened, err := NewDatabase(db.filename)
+	if err != nil {
+		t.Fatal("Cannot open database", err)
+	}
+	accounts, _ := reopened.ListAccounts("test@example.com")
+	rules, _ := reopened.MailboxRules("test@example.com")
+	if len(accounts) != 1 || accounts["testaccountid2"].DeviceToken != "testtoken2" || len(rules) != 1 {
+		t.Error("Unexpected user after replaying the journal", accounts, rules)
+	}
+	if _, ok := reopened.Users["alice@example.com"]; ok {
+		t.Error(`Users["alice@example.com"] is back after replaying the journal`)
+	}
+
+	// opening wrote a new snapshot and emptied the journal
+	if len(readFile(t, db.journal.filename)) != 0 {
+		t.Error("Journal was not emptied after replaying it")
+	}
+	if !bytes.Contains(readFile(t, db.filename), []byte("testaccountid2")) {
+		t.Error("Replayed journal was not written to the database file")
+	}
+}
+
+func TestJournal_UnchangedRegistration(t *testing.T) {
+	db, cleanup := newTestDatabase(t)
+	defer cleanup()
+
+	db.AddRegistration("test@example.com", "testaccountid1", "testtoken1", []string{"Inbox", "Notes"})
+	journal := readFile(t, db.journal.filename)
+	registered := db.Users["test@example.com"].Accounts["testaccountid1"].RegistrationTime
+
+	db.AddRegistration("test@example.com", "testaccountid1", "testtoken1", []string{"Inbox", "Notes"})
+	if !bytes.Equal(readFile(t, db.journal.filename), journal) {
+		t.Error("Registering again without changes was written to the journal")
+	}
+	account := db.Users["test@example.com"].Accounts["testaccountid1"]
+	if !account.RegistrationTime.After(registered) {
+		t.Error("Registering again without changes did not refresh the registration time")
+	}
+
+	// an old registration time is written
+	account.RegistrationTime = time.Now().Add(-2 * registrationRefresh)
+	db.Users["test@example.com"].Accounts["testaccountid1"] = account
+	db.AddRegistration("test@example.com", "testaccountid1", "testtoken1", []string{"Inbox", "Notes"})
+	if bytes.Equal(readFile(t, db.journal.filename), journal) {
+		t.Error("Refreshing an old registration time was not written to the journal")
+	}
+	journal = readFile(t, db.journal.filename)
+
+	db.AddRegistration("test@example.com", "testaccountid1", "testtoken1", []string{"Inbox"})
+	if bytes.Equal(readFile(t, db.journal.filename), journal) {
+		t.Error("Registering other mailboxes was not written to the journal")
+	}
+}
+
+func TestJournal_WriteFailure(t *testing.T) {
+	db, cleanup := newTestDatabase(t)
+	defer cleanup()
+
+	db.AddRegistration("test@example.com", "testaccountid1", "testtoken1", []string{"Inbox"})
+
+	// the next write fails once, like on a full disk
+	db.journal.file.Close()
+	if err := db.AddRegistration("test@example.com", "testaccountid2", "testtoken2", []string{"Inbox"}); err != nil {
+		t.Error("Change was lost when the journal failed", err)
+	}
+	if !bytes.Contains(readFile(t, db.filename), []byte("testaccountid2")) {
+		t.Error("Change was not written to a snapshot when the journal failed")
+	}
+
+	// later changes go to the journal again
+	if err := db.AddRegistration("test@example.com", "testaccountid3", "testtoken3", []string{"Inbox"}); err != nil {
+		t.Error("Journal is still broken after a snapshot", err)
+	}
+	if !bytes.Contains(readFile(t, db.journal.filename), []byte("testaccountid3")) {
+		t.Error("Change after the failure was not written to the journal")
+	}
+
+	reopened, err := NewDatabase(db.filename)
+	if err != nil {
+		t.Fatal("Cannot open database", err)
+	}
+	if accounts, _ := reopened.ListAccounts("test@example.com"); len(accounts) != 3 {
+		t.Error("Unexpected accounts after the journal failed", accounts)
+	}
+}
+
+func TestJournal_IncompleteRecord(t *testing.T) {
+	db, cleanup := newTestDatabase(t)
+	defer cleanup()
+
+	db.AddRegistration("test@example.com", "testaccountid1", "testtoken1", []string{"Inbox"})
+	db.AddRegistration("test@example.com", "testaccountid2", "testtoken2", []string{"Inbox"})
+
+	// a crash while appending the third record
+	f, err := os.OpenFile(db.journal.filename, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal("Cannot open journal", err)
+	}
+	f.Write([]byte(`{"Username":"test@example.com","User":{"Acc`))
+	f.Close()
+
+	reopened, err := NewDatabase(db.filename)
+	if err != nil {
+		t.Fatal("Cannot open database with an incomplete journal", err)
+	}
+	if accounts, _ := reopened.ListAccounts("test@example.com"); len(accounts) != 2 {
+		t.Error("Unexpected accounts after replaying the journal", accounts)
+	}
+}
+
+func TestJournal_Compaction(t *testing.T) {
+	defer func(compactAfter int) { CompactAfter = compactAfter }(CompactAfter)
+	CompactAfter = 3
+	db, cleanup := newTestDatabase(t)
+	defer cleanup()
+
+	db.AddRegistration("test@example.com", "testaccountid1", "testtoken1", []string{"Inbox"})
+	db.AddRegistration("test@example.com", "testaccountid2", "testtoken2", []string{"Inbox"})
+	if bytes.Contains(readFile(t, db.filename), []byte("testaccountid1")) {
+		t.Error("Database file was written before the journal was full")
+	}
+
+	db.AddRegistration("test@example.com", "testaccountid3", "testtoken3", []string{"Inbox"})
+	if len(readFile(t, db.journal.filename)) != 0 {
+		t.Error("Journal was not emptied after compacting it")
+	}
+	if !bytes.Contains(readFile(t, db.filename), []byte("testaccountid3")) {
+		t.Error("Journal was not compacted into the database file")
+	}
+
+	// closing compacts whatever is left
+	db.AddRegistration("test@example.com", "testaccountid4", "testtoken4", []string{"Inbox"})
+	if err := db.Close(); err != nil {
+		t.Fatal("Cannot close database", err)
+	}
+	if !bytes.Contains(readFile(t, db.filename), []byte("testaccountid4")) {
+		t.Error("Journal was not compacted when closing the database")
+	}
+}
+
+func TestJournal_PeriodicCompaction(t *testing.T) {
+	defer func(compactInterval time.Duration) { CompactInterval = compactInterval }(CompactInterval)
+	CompactInterval = 10 * time.Millisecond
+	db, cleanup := newTestDatabase(t)
+	defer cleanup()
+
+	db.AddRegistration("test@example.com", "testaccountid1", "testtoken1", []string{"Inbox"})
+	for i := 0; !bytes.Contains(readFile(t, db.filename), []byte("testaccountid1")); i++ {
+		if i == 100 {
+			t.Fatal("Journal was not compacted after the interval")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if db.journal.count() != 0 {
+		t.Error("Journal was not emptied after compacting it")
+	}
+}
+
+func TestJournal_RefreshedRegistrationTime(t *testing.T) {
+	db, cleanup := newTestDatabase(t)
+	defer cleanup()
+
+	db.AddRegistration("test@example.com", "testaccountid1", "testtoken1", []string{"Inbox"})
+	if err := db.compact(); err != nil {
+		t.Fatal("Cannot compact database", err)
+	}
+
+	// a refresh without a journal record is written when closing
+	db.AddRegistration("test@example.com", "testaccountid1", "testtoken1", []string{"Inbox"})
+	refreshed := db.Users["test@example.com"].Accounts["testaccountid1"].RegistrationTime
+	if err := db.Close(); err != nil {
+		t.Fatal("Cannot close database", err)
+	}
+
+	reopened, err := NewDatabase(db.filename)
+	if err != nil {
+		t.Fatal("Cannot open database", err)
+	}
+	defer reopened.Close()
+	if registered := reopened.Users["test@example.com"].Accounts["testaccountid1"].RegistrationTime; !registered.Equal(refreshed) {
+		t.Error("Refreshed registration time was lost after closing", registered, refreshed)
+	}
+}
+
+func TestJournal_ConcurrentChanges(t *testing.T) {
+	defer func(compactAfter int) { CompactAfter = compactAfter }(CompactAfter)
+	CompactAfter = 50
+	db, cleanup := newTestDatabase(t)
+	defer cleanup()
+
+	const workers = 16
+	const rounds = 20
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			username := "user" + strconv.Itoa(w)
+			for i := 0; i < rounds; i++ {
+				accountId := "account" + strconv.Itoa(i)
+				if err := db.AddRegistration(username, accountId, "token", []string{"Inbox"}); err != nil {
+					t.Error("Cannot addRegistration:", err)
+				}
+				if i%2 == 1 {
+					if _, err := db.DeleteRegistrations(username, accountId, ""); err != nil {
+						t.Error("Cannot deleteRegistrations:", err)
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	reopened, err := NewDatabase(db.filename)
+	if err != nil {
+		t.Fatal("Cannot open database", err)
+	}
+	for w := 0; w < workers; w++ {
+		if accounts, _ := reopened.ListAccounts("user" + strconv.Itoa(w)); len(accounts) != rounds/2 {
+			t.Error("Unexpected accounts of user", w, "after reopening", len(accounts))
+		}
+	}
+}
@@ -0,0 +1,382 @@
+//go:build sqlite
+
+// Package sqlite keeps the registrations in an SQLite database, which unlike
+// the JSON file does not have to be rewritten completely on every change.
+package sqlite
+
+import (
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+	log "github.com/sirupsen/logrus"
+	"github.com/st3fan/dovecot-xaps-daemon/database"
+	"github.com/st3fan/dovecot-xaps-daemon/mailboxname"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const timeLayout = time.RFC3339Nano
+
+// migrations bring the schema up to date. The number of migrations that were
+// run is kept in the user_version of the database, so new migrations must be
+// appended and old ones never changed.
+var migrations = []string{
+	`CREATE TABLE users (
+		id INTEGER PRIMARY KEY,
+		name TEXT NOT NULL UNIQUE
+	);
+	CREATE TABLE accounts (
+		id INTEGER PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		account_id TEXT NOT NULL,
+		device_token TEXT NOT NULL,
+		registration_time TEXT NOT NULL,
+		UNIQUE (user_id, account_id)
+	);
+	CREATE INDEX accounts_device_token ON accounts(device_token);
+	CREATE TABLE mailboxes (
+		account INTEGER NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+		position INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		normalized_name TEXT NOT NULL,
+		PRIMARY KEY (account, position)
+	);
+	CREATE INDEX mailboxes_normalized_name ON mailboxes(normalized_name);
+	CREATE TABLE mailbox_rules (
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		position INTEGER NOT NULL,
+		rule TEXT NOT NULL,
+		PRIMARY KEY (user_id, position)
+	);`,
+}
+
+// Store is a database.Store backed by SQLite.
+type Store struct {
+	db *sql.DB
+}
+
+var _ database.Store = &Store{}
+
+// NewStore opens the SQLite database in filename, creating it if it does not
+// exist, and migrates it to the current schema.
+func NewStore(filename string) (*Store, error) {
+	db, err := sql.Open("sqlite3", "file:"+url.PathEscape(filename)+"?_foreign_keys=on&_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	// a single connection serializes the writers, SQLite would do so anyway
+	db.SetMaxOpenConns(1)
+
+	store := &Store{db: db}
+	if err := store.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+func (store *Store) migrate() error {
+	var version int
+	if err := store.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	for ; version < len(migrations); version++ {
+		log.Infoln("Migrating SQLite database to schema version", version+1)
+		err := store.transaction(func(tx *sql.Tx) error {
+			if _, err := tx.Exec(migrations[version]); err != nil {
+				return err
+			}
+			// PRAGMA does not take parameters
+			_, err := tx.Exec("PRAGMA user_version = " + strconv.Itoa(version+1))
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transaction runs fn in a transaction, which is committed if fn returns nil
+// and rolled back otherwise.
+func (store *Store) transaction(fn func(tx *sql.Tx) error) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// userId returns the id of the user, creating the user if it does not exist.
+func userId(tx *sql.Tx, username string) (int64, error) {
+	if _, err := tx.Exec("INSERT OR IGNORE INTO users (name) VALUES (?)", username); err != nil {
+		return 0, err
+	}
+	var id int64
+	err := tx.QueryRow("SELECT id FROM users WHERE name = ?", username).Scan(&id)
+	return id, err
+}
+
+// deleteUnusedUsers removes users without accounts and mailbox rules.
+func deleteUnusedUsers(tx *sql.Tx) error {
+	_, err := tx.Exec(`DELETE FROM users WHERE
+		NOT EXISTS (SELECT 1 FROM accounts WHERE accounts.user_id = users.id) AND
+		NOT EXISTS (SELECT 1 FROM mailbox_rules WHERE mailbox_rules.user_id = users.id)`)
+	return err
+}
+
+func (store *Store) AddRegistration(username, accountId, deviceToken string, mailboxes []string) error {
+	return store.transaction(func(tx *sql.Tx) error {
+		user, err := userId(tx, username)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM accounts WHERE user_id = ? AND account_id = ?", user, accountId); err != nil {
+			return err
+		}
+		result, err := tx.Exec("INSERT INTO accounts (user_id, account_id, device_token, registration_time) VALUES (?, ?, ?, ?)",
+			user, accountId, deviceToken, time.Now().UTC().Format(timeLayout))
+		if err != nil {
+			return err
+		}
+		account, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		for position, mailbox := range mailboxes {
+			_, err := tx.Exec("INSERT INTO mailboxes (account, position, name, normalized_name) VALUES (?, ?, ?, ?)",
+				account, position, mailbox, mailboxname.Normalize(mailbox))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (store *Store) FindRegistrations(username, mailbox string) ([]database.Registration, error) {
+	rows, err := store.db.Query(`SELECT DISTINCT accounts.account_id, accounts.device_token
+		FROM users
+		JOIN accounts ON accounts.user_id = users.id
+		JOIN mailboxes ON mailboxes.account = accounts.id
+		WHERE users.name = ? AND mailboxes.normalized_name = ?`, username, mailboxname.Normalize(mailbox))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var registrations []database.Registration
+	for rows.Next() {
+		var registration database.Registration
+		if err := rows.Scan(&registration.AccountId, &registration.DeviceToken); err != nil {
+			return nil, err
+		}
+		registrations = append(registrations, registration)
+	}
+	return registrations, rows.Err()
+}
+
+// DeleteIfExistRegistration removes all accounts with the device token that
+// were registered before the device was reported as gone.
+func (store *Store) DeleteIfExistRegistration(deviceToken string, deletedTimestamp time.Time) ([]database.Registration, error) {
+	var removed []database.Registration
+	err := store.transaction(func(tx *sql.Tx) error {
+		rows, err := tx.Query("SELECT id, account_id, registration_time FROM accounts WHERE device_token = ?", deviceToken)
+		if err != nil {
+			return err
+		}
+		var ids []int64
+		for rows.Next() {
+			var id int64
+			var accountId, registrationTime string
+			if err := rows.Scan(&id, &accountId, &registrationTime); err != nil {
+				rows.Close()
+				return err
+			}
+			if t, err := time.Parse(timeLayout, registrationTime); err == nil && t.Before(deletedTimestamp) {
+				ids = append(ids, id)
+				removed = append(removed, database.Registration{DeviceToken: deviceToken, AccountId: accountId})
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			if _, err := tx.Exec("DELETE FROM accounts WHERE id = ?", id); err != nil {
+				return err
+			}
+		}
+		return deleteUnusedUsers(tx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
+
+func (store *Store) DeleteRegistrations(username, accountId, deviceToken string) ([]database.Registration, error) {
+	var removed []database.Registration
+	err := store.transaction(func(tx *sql.Tx) error {
+		query := `SELECT accounts.id, accounts.account_id, accounts.device_token FROM accounts
+			JOIN users ON users.id = accounts.user_id
+			WHERE users.name = ? AND accounts.device_token = ?`
+		arg := deviceToken
+		if accountId != "" {
+			query = `SELECT accounts.id, accounts.account_id, accounts.device_token FROM accounts
+				JOIN users ON users.id = accounts.user_id
+				WHERE users.name = ? AND accounts.account_id = ?`
+			arg = accountId
+		}
+		rows, err := tx.Query(query, username, arg)
+		if err != nil {
+			return err
+		}
+		var ids []int64
+		for rows.Next() {
+			var id int64
+			var registration database.Registration
+			if err := rows.Scan(&id, &registration.AccountId, &registration.DeviceToken); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+			removed = append(removed, registration)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			if _, err := tx.Exec("DELETE FROM accounts WHERE id = ?", id); err != nil {
+				return err
+			}
+		}
+		return deleteUnusedUsers(tx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
+
+func (store *Store) ListAccounts(username string) (map[string]database.Account, error) {
+	accounts := make(map[string]database.Account)
+	err := store.iterate("WHERE users.name = ?", []interface{}{username}, func(_, accountId string, account database.Account) error {
+		accounts[accountId] = account
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+func (store *Store) Iterate(fn func(username, accountId string, account database.Account) error) error {
+	err := store.iterate("", nil, fn)
+	if err == database.ErrStopIteration {
+		return nil
+	}
+	return err
+}
+
+// iterate calls fn for the accounts that match the where clause, with their
+// mailboxes in the order they were registered in.
+func (store *Store) iterate(where string, args []interface{}, fn func(username, accountId string, account database.Account) error) error {
+	rows, err := store.db.Query(`SELECT accounts.id, users.name, accounts.account_id, accounts.device_token,
+			accounts.registration_time, mailboxes.name
+		FROM users
+		JOIN accounts ON accounts.user_id = users.id
+		LEFT JOIN mailboxes ON mailboxes.account = accounts.id
+		`+where+`
+		ORDER BY accounts.id, mailboxes.position`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	// rows of the same account follow each other, one per mailbox
+	var current int64 = -1
+	var username, accountId string
+	var account database.Account
+	for rows.Next() {
+		var id int64
+		var name, rowAccountId, deviceToken, registrationTime string
+		var mailbox sql.NullString
+		if err := rows.Scan(&id, &name, &rowAccountId, &deviceToken, &registrationTime, &mailbox); err != nil {
+			return err
+		}
+		if id != current {
+			if current != -1 {
+				if err := fn(username, accountId, account); err != nil {
+					return err
+				}
+			}
+			current, username, accountId = id, name, rowAccountId
+			account = database.Account{DeviceToken: deviceToken, Mailboxes: []string{}}
+			if account.RegistrationTime, err = time.Parse(timeLayout, registrationTime); err != nil {
+				return err
+			}
+		}
+		if mailbox.Valid {
+			account.Mailboxes = append(account.Mailboxes, mailbox.String)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if current != -1 {
+		return fn(username, accountId, account)
+	}
+	return nil
+}
+
+func (store *Store) SetMailboxRules(username string, rules []string) error {
+	return store.transaction(func(tx *sql.Tx) error {
+		user, err := userId(tx, username)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM mailbox_rules WHERE user_id = ?", user); err != nil {
+			return err
+		}
+		for position, rule := range rules {
+			_, err := tx.Exec("INSERT INTO mailbox_rules (user_id, position, rule) VALUES (?, ?, ?)", user, position, rule)
+			if err != nil {
+				return err
+			}
+		}
+		return deleteUnusedUsers(tx)
+	})
+}
+
+func (store *Store) MailboxRules(username string) ([]string, error) {
+	rows, err := store.db.Query(`SELECT mailbox_rules.rule FROM mailbox_rules
+		JOIN users ON users.id = mailbox_rules.user_id
+		WHERE users.name = ?
+		ORDER BY mailbox_rules.position`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []string
+	for rows.Next() {
+		var rule string
+		if err := rows.Scan(&rule); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+func (store *Store) Close() error {
+	return store.db.Close()
+}
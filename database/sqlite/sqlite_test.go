@@ -0,0 +1,84 @@
+//go:build sqlite
+
+package sqlite
+
+import (
+	"github.com/st3fan/dovecot-xaps-daemon/database"
+	"github.com/st3fan/dovecot-xaps-daemon/database/storetest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(dir string) (database.Store, error) {
+		return NewStore(filepath.Join(dir, "database.sqlite"))
+	})
+}
+
+func TestStore_Migrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xapsd_sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "database.sqlite")
+
+	store, err := NewStore(filename)
+	if err != nil {
+		t.Fatal("Cannot create store:", err)
+	}
+	var version int
+	if err := store.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil || version != len(migrations) {
+		t.Error("Unexpected schema version", version, err)
+	}
+	if err := store.AddRegistration("stefan", "account1", "token1", []string{"INBOX"}); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	// opening a current database must not run the migrations again
+	store, err = NewStore(filename)
+	if err != nil {
+		t.Fatal("Cannot reopen store:", err)
+	}
+	defer store.Close()
+	registrations, err := store.FindRegistrations("stefan", "INBOX")
+	if err != nil || len(registrations) != 1 {
+		t.Error("Registration lost after reopening", registrations, err)
+	}
+}
+
+func TestStore_DeleteUnusedUsers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xapsd_sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewStore(filepath.Join(dir, "database.sqlite"))
+	if err != nil {
+		t.Fatal("Cannot create store:", err)
+	}
+	defer store.Close()
+
+	store.AddRegistration("stefan", "account1", "token1", []string{"INBOX"})
+	store.SetMailboxRules("stefan", []string{"Junk=ignore"})
+	store.DeleteRegistrations("stefan", "account1", "")
+	if users := countUsers(t, store); users != 1 {
+		t.Error("User with mailbox rules was deleted", users)
+	}
+	store.SetMailboxRules("stefan", nil)
+	if users := countUsers(t, store); users != 0 {
+		t.Error("User without accounts and rules was kept", users)
+	}
+}
+
+func countUsers(t *testing.T, store *Store) int {
+	var users int
+	if err := store.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&users); err != nil {
+		t.Fatal(err)
+	}
+	return users
+}
@@ -0,0 +1,41 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+// Store keeps the registrations and mailbox rules of all users. Database,
+// which keeps everything in a JSON file, is one implementation. Every
+// implementation must pass the tests in database/storetest and be safe for
+// concurrent use.
+type Store interface {
+	// AddRegistration creates or replaces the account of the user.
+	AddRegistration(username, accountId, deviceToken string, mailboxes []string) error
+	// FindRegistrations returns the accounts of the user that registered
+	// for the mailbox.
+	FindRegistrations(username, mailbox string) ([]Registration, error)
+	// DeleteIfExistRegistration removes the accounts with the device token
+	// that were registered before the device was reported as gone, and
+	// returns them.
+	DeleteIfExistRegistration(deviceToken string, deletedTimestamp time.Time) ([]Registration, error)
+	// DeleteRegistrations removes the accounts of the user that match the
+	// account id or, if that is empty, the device token.
+	DeleteRegistrations(username, accountId, deviceToken string) ([]Registration, error)
+	// ListAccounts returns a copy of all accounts of the user.
+	ListAccounts(username string) (map[string]Account, error)
+	// Iterate calls fn for every account of every user, until fn returns
+	// an error. That error is returned, unless it is ErrStopIteration.
+	// fn must not call the store.
+	Iterate(fn func(username, accountId string, account Account) error) error
+	// SetMailboxRules replaces the mailbox rules of the user.
+	SetMailboxRules(username string, rules []string) error
+	// MailboxRules returns a copy of the mailbox rules of the user.
+	MailboxRules(username string) ([]string, error)
+	// Close releases the resources of the store.
+	Close() error
+}
+
+// ErrStopIteration can be returned by the function passed to Iterate to stop
+// early without an error.
+var ErrStopIteration = errors.New("stop iteration")
@@ -0,0 +1,14 @@
+package database_test
+
+import (
+	"github.com/st3fan/dovecot-xaps-daemon/database"
+	"github.com/st3fan/dovecot-xaps-daemon/database/storetest"
+	"path/filepath"
+	"testing"
+)
+
+func TestDatabase_Store(t *testing.T) {
+	storetest.Run(t, func(dir string) (database.Store, error) {
+		return database.NewDatabase(filepath.Join(dir, "database.json"))
+	})
+}
@@ -0,0 +1,399 @@
+// Package storetest holds the tests that every implementation of
+// database.Store has to pass. Call Run from a test of the implementation.
+package storetest
+
+import (
+	"errors"
+	"github.com/st3fan/dovecot-xaps-daemon/database"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Factory opens the store kept in dir, creating it if dir is still empty.
+// Opening the same dir again after Close must return the same data.
+type Factory func(dir string) (database.Store, error)
+
+// Run runs all conformance tests against the stores opened by open.
+func Run(t *testing.T, open Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, open func() database.Store)
+	}{
+		{"AddAndFind", testAddAndFind},
+		{"ReplaceAccount", testReplaceAccount},
+		{"DeleteRegistrations", testDeleteRegistrations},
+		{"DeleteIfExistRegistration", testDeleteIfExistRegistration},
+		{"RegisterAgain", testRegisterAgain},
+		{"ListAccounts", testListAccounts},
+		{"Iterate", testIterate},
+		{"MailboxRules", testMailboxRules},
+		{"Persistence", testPersistence},
+		{"ConcurrentAccess", testConcurrentAccess},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "xapsd_storetest")
+			if err != nil {
+				t.Fatal("Cannot create temporary directory", err)
+			}
+			defer os.RemoveAll(dir)
+
+			var stores []database.Store
+			defer func() {
+				for _, store := range stores {
+					store.Close()
+				}
+			}()
+			test.test(t, func() database.Store {
+				store, err := open(dir)
+				if err != nil {
+					t.Fatal("Cannot open store", err)
+				}
+				stores = append(stores, store)
+				return store
+			})
+		})
+	}
+}
+
+func add(t *testing.T, store database.Store, username, accountId, deviceToken string, mailboxes ...string) {
+	if err := store.AddRegistration(username, accountId, deviceToken, mailboxes); err != nil {
+		t.Fatal("Cannot add registration", err)
+	}
+}
+
+func find(t *testing.T, store database.Store, username, mailbox string) []database.Registration {
+	registrations, err := store.FindRegistrations(username, mailbox)
+	if err != nil {
+		t.Fatal("Cannot find registrations", err)
+	}
+	sort.Slice(registrations, func(i, j int) bool {
+		return registrations[i].AccountId < registrations[j].AccountId
+	})
+	return registrations
+}
+
+func accounts(t *testing.T, store database.Store, username string) map[string]database.Account {
+	accounts, err := store.ListAccounts(username)
+	if err != nil {
+		t.Fatal("Cannot list accounts", err)
+	}
+	return accounts
+}
+
+func testAddAndFind(t *testing.T, open func() database.Store) {
+	store := open()
+	add(t, store, "stefan", "account1", "token1", "INBOX")
+	add(t, store, "stefan", "account2", "token2", "Inbox", "Ham")
+	add(t, store, "alice", "account3", "token3", "INBOX")
+
+	registrations := find(t, store, "stefan", "inbox")
+	if len(registrations) != 2 ||
+		registrations[0] != (database.Registration{AccountId: "account1", DeviceToken: "token1"}) ||
+		registrations[1] != (database.Registration{AccountId: "account2", DeviceToken: "token2"}) {
+		t.Error("unexpected registrations for stefan/inbox", registrations)
+	}
+	if registrations := find(t, store, "stefan", "Ham"); len(registrations) != 1 || registrations[0].AccountId != "account2" {
+		t.Error("unexpected registrations for stefan/Ham", registrations)
+	}
+	if registrations := find(t, store, "stefan", "Spam"); len(registrations) != 0 {
+		t.Error("unexpected registrations for stefan/Spam", registrations)
+	}
+	if registrations := find(t, store, "nobody", "INBOX"); len(registrations) != 0 {
+		t.Error("unexpected registrations for nobody", registrations)
+	}
+}
+
+func testReplaceAccount(t *testing.T, open func() database.Store) {
+	store := open()
+	add(t, store, "stefan", "account1", "token1", "INBOX")
+	add(t, store, "stefan", "account1", "token2", "Notes")
+
+	if registrations := find(t, store, "stefan", "INBOX"); len(registrations) != 0 {
+		t.Error("old mailboxes are still registered", registrations)
+	}
+	registrations := find(t, store, "stefan", "Notes")
+	if len(registrations) != 1 || registrations[0].DeviceToken != "token2" {
+		t.Error("account was not replaced", registrations)
+	}
+}
+
+func testDeleteRegistrations(t *testing.T, open func() database.Store) {
+	store := open()
+	add(t, store, "stefan", "account1", "token1", "INBOX")
+	add(t, store, "stefan", "account2", "token2", "INBOX")
+	add(t, store, "stefan", "account3", "token2", "INBOX")
+
+	removed, err := store.DeleteRegistrations("stefan", "account1", "")
+	if err != nil || len(removed) != 1 || removed[0] != (database.Registration{AccountId: "account1", DeviceToken: "token1"}) {
+		t.Error("unexpected removed registrations by account id", removed, err)
+	}
+	removed, err = store.DeleteRegistrations("stefan", "", "token2")
+	if err != nil || len(removed) != 2 {
+		t.Error("unexpected removed registrations by device token", removed, err)
+	}
+	removed, err = store.DeleteRegistrations("nobody", "", "token2")
+	if err != nil || len(removed) != 0 {
+		t.Error("removed registrations of an unknown user", removed, err)
+	}
+	if accounts := accounts(t, store, "stefan"); len(accounts) != 0 {
+		t.Error("accounts are left after removing all", accounts)
+	}
+}
+
+func testDeleteIfExistRegistration(t *testing.T, open func() database.Store) {
+	store := open()
+	add(t, store, "stefan", "account1", "token1", "INBOX")
+	add(t, store, "stefan", "account2", "token2", "INBOX")
+	// the same device registered for another user
+	add(t, store, "alice", "account3", "token1", "INBOX")
+
+	if removed, err := store.DeleteIfExistRegistration("token1", time.Now().Add(-time.Hour)); err != nil || len(removed) != 0 {
+		t.Error("removed a registration that is newer than the feedback", removed, err)
+	}
+	removed, err := store.DeleteIfExistRegistration("token1", time.Now().Add(time.Hour))
+	sort.Slice(removed, func(i, j int) bool {
+		return removed[i].AccountId < removed[j].AccountId
+	})
+	if err != nil || len(removed) != 2 ||
+		removed[0] != (database.Registration{AccountId: "account1", DeviceToken: "token1"}) ||
+		removed[1] != (database.Registration{AccountId: "account3", DeviceToken: "token1"}) {
+		t.Error("did not remove the registrations that are older than the feedback", removed, err)
+	}
+	if removed, err := store.DeleteIfExistRegistration("unknown", time.Now().Add(time.Hour)); err != nil || len(removed) != 0 {
+		t.Error("removed an unknown device token", removed, err)
+	}
+
+	registrations := find(t, store, "stefan", "INBOX")
+	if len(registrations) != 1 || registrations[0].AccountId != "account2" {
+		t.Error("unexpected registrations after feedback", registrations)
+	}
+
+	// the removal must survive a restart
+	if err := store.Close(); err != nil {
+		t.Fatal("Cannot close store", err)
+	}
+	store = open()
+	if registrations := find(t, store, "stefan", "INBOX"); len(registrations) != 1 {
+		t.Error("unexpected registrations after reopening", registrations)
+	}
+	if list := accounts(t, store, "alice"); len(list) != 0 {
+		t.Error("unexpected accounts after reopening", list)
+	}
+}
+
+func testRegisterAgain(t *testing.T, open func() database.Store) {
+	store := open()
+	add(t, store, "stefan", "account1", "token1", "INBOX")
+	feedback := time.Now()
+
+	// registering again without changes is newer than the feedback
+	add(t, store, "stefan", "account1", "token1", "INBOX")
+	if registered := accounts(t, store, "stefan")["account1"].RegistrationTime; !registered.After(feedback) {
+		t.Error("registering again did not refresh the registration time", registered, feedback)
+	}
+	if removed, err := store.DeleteIfExistRegistration("token1", feedback); err != nil || len(removed) != 0 {
+		t.Error("removed a registration that was registered again after the feedback", removed, err)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatal("Cannot close store", err)
+	}
+	store = open()
+	if registered := accounts(t, store, "stefan")["account1"].RegistrationTime; !registered.After(feedback) {
+		t.Error("refreshed registration time was lost after reopening", registered, feedback)
+	}
+}
+
+func testListAccounts(t *testing.T, open func() database.Store) {
+	store := open()
+	before := time.Now().Add(-time.Second)
+	add(t, store, "stefan", "account1", "token1", "INBOX", "Notes")
+
+	list := accounts(t, store, "stefan")
+	account, ok := list["account1"]
+	if len(list) != 1 || !ok || account.DeviceToken != "token1" || len(account.Mailboxes) != 2 ||
+		account.Mailboxes[0] != "INBOX" || account.Mailboxes[1] != "Notes" {
+		t.Error("unexpected accounts", list)
+	}
+	if account.RegistrationTime.Before(before) || account.RegistrationTime.After(time.Now().Add(time.Second)) {
+		t.Error("unexpected registration time", account.RegistrationTime)
+	}
+
+	// the result is a copy
+	account.Mailboxes[0] = "Changed"
+	if accounts(t, store, "stefan")["account1"].Mailboxes[0] != "INBOX" {
+		t.Error("ListAccounts does not return a copy of the mailboxes")
+	}
+
+	if list := accounts(t, store, "nobody"); len(list) != 0 {
+		t.Error("unexpected accounts for nobody", list)
+	}
+}
+
+func testIterate(t *testing.T, open func() database.Store) {
+	store := open()
+	add(t, store, "stefan", "account1", "token1", "INBOX")
+	add(t, store, "stefan", "account2", "token2", "INBOX")
+	add(t, store, "alice", "account3", "token3", "Notes")
+
+	seen := make(map[string]string)
+	err := store.Iterate(func(username, accountId string, account database.Account) error {
+		seen[accountId] = username + "/" + account.DeviceToken
+		return nil
+	})
+	if err != nil {
+		t.Error("Cannot iterate", err)
+	}
+	if len(seen) != 3 || seen["account1"] != "stefan/token1" || seen["account3"] != "alice/token3" {
+		t.Error("unexpected accounts", seen)
+	}
+
+	calls := 0
+	err = store.Iterate(func(username, accountId string, account database.Account) error {
+		calls++
+		return database.ErrStopIteration
+	})
+	if err != nil || calls != 1 {
+		t.Error("ErrStopIteration did not stop the iteration", calls, err)
+	}
+
+	failure := errors.New("failure")
+	err = store.Iterate(func(username, accountId string, account database.Account) error {
+		return failure
+	})
+	if err != failure {
+		t.Error("Iterate did not return the error", err)
+	}
+}
+
+func testMailboxRules(t *testing.T, open func() database.Store) {
+	store := open()
+	add(t, store, "stefan", "account1", "token1", "INBOX")
+
+	if err := store.SetMailboxRules("stefan", []string{"Junk=ignore", "Support=immediate"}); err != nil {
+		t.Fatal("Cannot set mailbox rules", err)
+	}
+	if err := store.SetMailboxRules("rulesonly", []string{"Trash=ignore"}); err != nil {
+		t.Fatal("Cannot set mailbox rules", err)
+	}
+
+	rules, err := store.MailboxRules("stefan")
+	if err != nil || len(rules) != 2 || rules[0] != "Junk=ignore" || rules[1] != "Support=immediate" {
+		t.Error("unexpected mailbox rules", rules, err)
+	}
+	rules[0] = "Changed"
+	if rules, _ := store.MailboxRules("stefan"); rules[0] != "Junk=ignore" {
+		t.Error("MailboxRules does not return a copy of the rules")
+	}
+
+	// rules outlive the accounts of the user and the other way around
+	store.DeleteRegistrations("stefan", "account1", "")
+	if rules, err := store.MailboxRules("stefan"); err != nil || len(rules) != 2 {
+		t.Error("mailbox rules were removed with the last account", rules, err)
+	}
+	add(t, store, "stefan", "account1", "token1", "INBOX")
+	if err := store.SetMailboxRules("stefan", nil); err != nil {
+		t.Error("Cannot remove mailbox rules", err)
+	}
+	if rules, err := store.MailboxRules("stefan"); err != nil || len(rules) != 0 {
+		t.Error("mailbox rules were not removed", rules, err)
+	}
+	if len(find(t, store, "stefan", "INBOX")) != 1 {
+		t.Error("account was removed with the mailbox rules")
+	}
+
+	if rules, err := store.MailboxRules("nobody"); err != nil || len(rules) != 0 {
+		t.Error("unexpected mailbox rules for nobody", rules, err)
+	}
+}
+
+func testPersistence(t *testing.T, open func() database.Store) {
+	store := open()
+	add(t, store, "stefan", "account1", "token1", "INBOX")
+	add(t, store, "stefan", "account2", "token2", "INBOX")
+	store.DeleteRegistrations("stefan", "account2", "")
+	store.SetMailboxRules("alice", []string{"Junk=ignore"})
+	if err := store.Close(); err != nil {
+		t.Fatal("Cannot close store", err)
+	}
+
+	store = open()
+	registrations := find(t, store, "stefan", "INBOX")
+	if len(registrations) != 1 || registrations[0] != (database.Registration{AccountId: "account1", DeviceToken: "token1"}) {
+		t.Error("unexpected registrations after reopening", registrations)
+	}
+	if account := accounts(t, store, "stefan")["account1"]; account.RegistrationTime.IsZero() {
+		t.Error("registration time was not kept")
+	}
+	if rules, err := store.MailboxRules("alice"); err != nil || len(rules) != 1 {
+		t.Error("unexpected mailbox rules after reopening", rules, err)
+	}
+}
+
+func testConcurrentAccess(t *testing.T, open func() database.Store) {
+	store := open()
+	const workers = 8
+	const rounds = 25
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*rounds)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			username := "user" + strconv.Itoa(w)
+			for i := 0; i < rounds; i++ {
+				accountId := "account" + strconv.Itoa(i)
+				// everybody shares one user as well
+				if err := store.AddRegistration("shared", username+accountId, "token", []string{"INBOX"}); err != nil {
+					errs <- err
+				}
+				if err := store.AddRegistration(username, accountId, "token"+strconv.Itoa(i), []string{"INBOX"}); err != nil {
+					errs <- err
+				}
+				if _, err := store.FindRegistrations("shared", "INBOX"); err != nil {
+					errs <- err
+				}
+				if _, err := store.ListAccounts(username); err != nil {
+					errs <- err
+				}
+				if err := store.SetMailboxRules(username, []string{"Junk=ignore"}); err != nil {
+					errs <- err
+				}
+				if _, err := store.MailboxRules("shared"); err != nil {
+					errs <- err
+				}
+				store.Iterate(func(username, accountId string, account database.Account) error {
+					return nil
+				})
+				if i%2 == 1 {
+					if _, err := store.DeleteRegistrations(username, accountId, ""); err != nil {
+						errs <- err
+					}
+				}
+				store.DeleteIfExistRegistration("unknown", time.Now())
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error("concurrent access failed", err)
+	}
+
+	if shared := accounts(t, store, "shared"); len(shared) != workers*rounds {
+		t.Error("len(shared accounts) != workers*rounds", len(shared))
+	}
+	for w := 0; w < workers; w++ {
+		if own := accounts(t, store, "user"+strconv.Itoa(w)); len(own) != rounds-rounds/2 {
+			t.Error("unexpected number of accounts", len(own))
+		}
+	}
+}
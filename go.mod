@@ -1,17 +1,20 @@
-module dovecot-xaps-daemon
+module github.com/st3fan/dovecot-xaps-daemon
 
-go 1.12
+go 1.18
 
 require (
 	github.com/go-redis/redis v6.15.2+incompatible
-	github.com/onsi/ginkgo v0.0.0-20180119174237-747514b53ddd // indirect
-	github.com/onsi/gomega v1.3.0 // indirect
+	github.com/mattn/go-sqlite3 v1.14.22
 	github.com/sirupsen/logrus v0.0.0-20180129181852-768a92a02685
-	github.com/st3fan/dovecot-xaps-daemon v0.0.0-20190315235014-af50c8175e09
 	github.com/timehop/apns v0.0.0-20160922055839-7dfe710e494f
+)
+
+require (
+	github.com/onsi/ginkgo v0.0.0-20180119174237-747514b53ddd // indirect
+	github.com/onsi/gomega v1.3.0 // indirect
 	golang.org/x/crypto v0.0.0-20180127211104-1875d0a70c90 // indirect
 	golang.org/x/net v0.0.0-20180124060956-0ed95abb35c4 // indirect
-	golang.org/x/sys v0.0.0-20180126165840-ff2a66f350ce // indirect
+	golang.org/x/sys v0.0.0-20190204203706-41f3e6584952 // indirect
 	golang.org/x/text v0.0.0-20171227012246-e19ae1496984 // indirect
 	gopkg.in/yaml.v2 v2.0.0 // indirect
 )
@@ -0,0 +1,73 @@
+// Package mailboxname compares the names of IMAP mailboxes that came from
+// different clients. It is shared by the database and the policies and
+// depends on nothing else.
+package mailboxname
+
+import (
+	"encoding/base64"
+	"strings"
+	"unicode/utf16"
+)
+
+// Separator is the hierarchy separator of the IMAP namespace, "/" or ".".
+// With "." a '.' in a name separates hierarchy levels like '/' does, so
+// "Archive.2019" and "Archive/2019" are the same mailbox. With "/" they are
+// not, and "Lists/v1.2" stays different from "Lists/v1/2". It has to be set
+// before any name is normalized.
+var Separator = "/"
+
+// Normalize turns a mailbox name into a form that can be compared with names
+// that came from other clients. Names in modified UTF-7, as used by IMAP,
+// are decoded to UTF-8. A '.' is replaced by '/' if it is the Separator.
+// INBOX is case-insensitive, also as the parent of other mailboxes.
+func Normalize(name string) string {
+	name = decodeModifiedUTF7(name)
+	if Separator == "." {
+		name = strings.Replace(name, ".", "/", -1)
+	}
+
+	parts := strings.SplitN(name, "/", 2)
+	if strings.EqualFold(parts[0], "INBOX") {
+		parts[0] = "INBOX"
+	}
+	return strings.Join(parts, "/")
+}
+
+// decodeModifiedUTF7 decodes a mailbox name in modified UTF-7 as described in
+// RFC 3501, section 5.1.3. Names that are not valid modified UTF-7, like
+// names that already are UTF-8, are returned as they are.
+func decodeModifiedUTF7(name string) string {
+	var decoded strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c < 0x20 || c > 0x7e {
+			return name
+		}
+		if c != '&' {
+			decoded.WriteByte(c)
+			continue
+		}
+
+		end := strings.IndexByte(name[i+1:], '-')
+		if end == -1 {
+			return name
+		}
+		chunk := name[i+1 : i+1+end]
+		i += end + 1
+		if chunk == "" {
+			decoded.WriteByte('&')
+			continue
+		}
+
+		data, err := base64.RawStdEncoding.DecodeString(strings.Replace(chunk, ",", "/", -1))
+		if err != nil || len(data)%2 != 0 {
+			return name
+		}
+		units := make([]uint16, len(data)/2)
+		for j := range units {
+			units[j] = uint16(data[2*j])<<8 | uint16(data[2*j+1])
+		}
+		decoded.WriteString(string(utf16.Decode(units)))
+	}
+	return decoded.String()
+}
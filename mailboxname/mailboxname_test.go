@@ -0,0 +1,56 @@
+package mailboxname
+
+import (
+	"testing"
+)
+
+func Test_Normalize(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"INBOX", "INBOX"},
+		{"Inbox", "INBOX"},
+		{"inbox", "INBOX"},
+		{"Inbox.Support", "Inbox.Support"},
+		{"INBOX/Support", "INBOX/Support"},
+		{"Inboxes", "Inboxes"},
+		{"Sent", "Sent"},
+		{"Archive.2019", "Archive.2019"},
+		{"Lists/v1.2", "Lists/v1.2"},
+		{"Entw&APw-rfe", "Entwürfe"},
+		{"Entwürfe", "Entwürfe"},
+		{"&ZeVnLIqe-", "日本語"},
+		{"Tom &- Jerry", "Tom & Jerry"},
+		{"Tom & Jerry", "Tom & Jerry"},
+		{"&Jjo-!", "☺!"},
+		{"Support/&AOQ-", "Support/ä"},
+	}
+	for _, test := range tests {
+		if normalized := Normalize(test.name); normalized != test.expected {
+			t.Errorf("Normalize(%q) = %q, expected %q", test.name, normalized, test.expected)
+		}
+	}
+}
+
+func Test_Normalize_DotSeparator(t *testing.T) {
+	defer func(separator string) { Separator = separator }(Separator)
+	Separator = "."
+
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"Inbox.Support", "INBOX/Support"},
+		{"INBOX/Support", "INBOX/Support"},
+		{"Archive.2019", "Archive/2019"},
+		{"Entw&APw-rfe.Alt", "Entwürfe/Alt"},
+		// there is no way to tell these apart with a '.' separator
+		{"Lists/v1.2", "Lists/v1/2"},
+	}
+	for _, test := range tests {
+		if normalized := Normalize(test.name); normalized != test.expected {
+			t.Errorf("Normalize(%q) = %q, expected %q", test.name, normalized, test.expected)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package policy
+
+import (
+	"errors"
+	"github.com/st3fan/dovecot-xaps-daemon/mailboxname"
+	"path"
+	"strings"
+	"time"
+)
+
+// MailboxPolicy overrides the event policy for mailboxes that match a name
+// or a glob pattern.
+type MailboxPolicy struct {
+	rules []mailboxRule
+}
+
+type mailboxRule struct {
+	pattern string
+	rule    Rule
+}
+
+// ParseMailboxPolicy reads a comma separated list of mailbox rules, for
+// example:
+//
+//	Junk=ignore,Trash=ignore,Sent*=ignore,Support=immediate
+//
+// See ParseMailboxRules for the format of a single rule.
+func ParseMailboxPolicy(spec string, defaultDelay time.Duration) (*MailboxPolicy, error) {
+	var entries []string
+	for _, entry := range strings.Split(spec, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return ParseMailboxRules(entries, defaultDelay)
+}
+
+// ParseMailboxRules reads mailbox rules of the form <pattern>=<rule>. The
+// pattern is a mailbox name or a glob pattern as understood by path.Match,
+// where '*' does not cross hierarchy levels. Patterns are normalized like
+// mailbox names, so "Archive.*" matches "Archive/2019" if the hierarchy
+// separator is ".", see mailboxname.Separator. The first pattern that
+// matches a mailbox decides.
+func ParseMailboxRules(entries []string, defaultDelay time.Duration) (*MailboxPolicy, error) {
+	policy := &MailboxPolicy{}
+	for _, entry := range entries {
+		separator := strings.LastIndexByte(entry, '=')
+		if separator <= 0 {
+			return nil, errors.New("invalid mailbox rule: " + entry)
+		}
+		pattern := mailboxname.Normalize(entry[:separator])
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.New("invalid mailbox pattern: " + entry)
+		}
+		rule, err := ParseRule(entry[separator+1:], defaultDelay)
+		if err != nil {
+			return nil, err
+		}
+		policy.rules = append(policy.rules, mailboxRule{pattern: pattern, rule: rule})
+	}
+	return policy, nil
+}
+
+// Rule returns the rule of the first pattern that matches the mailbox. The
+// second value is false when no pattern matches.
+func (policy *MailboxPolicy) Rule(mailbox string) (Rule, bool) {
+	if policy == nil {
+		return Rule{}, false
+	}
+	mailbox = mailboxname.Normalize(mailbox)
+	for _, r := range policy.rules {
+		if matched, _ := path.Match(r.pattern, mailbox); matched {
+			return r.rule, true
+		}
+	}
+	return Rule{}, false
+}
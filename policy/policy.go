@@ -0,0 +1,154 @@
+package policy
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Action tells what to do with a notification.
+type Action int
+
+const (
+	// send the notification right away
+	Immediate Action = iota
+	// send the notification after a delay, further events restart the delay
+	Delayed
+	// do not send a notification at all
+	Ignored
+)
+
+func (action Action) String() string {
+	switch action {
+	case Immediate:
+		return "immediate"
+	case Delayed:
+		return "delayed"
+	case Ignored:
+		return "ignore"
+	}
+	return "unknown"
+}
+
+// Rule is an action with its delay, which only matters for Delayed actions.
+type Rule struct {
+	Action Action
+	Delay  time.Duration
+}
+
+// EventPolicy decides per Dovecot event type how devices are notified.
+type EventPolicy struct {
+	rules        map[string]Rule
+	fallback     Rule
+	defaultDelay time.Duration
+}
+
+// DefaultEventPolicy notifies right away for new messages and after the
+// default delay for everything else.
+func DefaultEventPolicy(defaultDelay time.Duration) *EventPolicy {
+	return &EventPolicy{
+		rules:        map[string]Rule{"messagenew": {Action: Immediate}},
+		fallback:     Rule{Action: Delayed, Delay: defaultDelay},
+		defaultDelay: defaultDelay,
+	}
+}
+
+// DefaultDelay is the delay of delayed rules that do not specify one.
+func (policy *EventPolicy) DefaultDelay() time.Duration {
+	return policy.defaultDelay
+}
+
+// ParseEventPolicy reads a comma separated list of event rules on top of the
+// default policy, for example:
+//
+//	MessageNew=immediate,MessageExpunge=delayed:60,FlagsSet=ignore,*=delayed
+//
+// The delay is given in seconds, without it the default delay is used. The
+// event "*" stands for all events without a rule of their own. Event names
+// are case-insensitive.
+func ParseEventPolicy(spec string, defaultDelay time.Duration) (*EventPolicy, error) {
+	policy := DefaultEventPolicy(defaultDelay)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		nameAndRule := strings.SplitN(entry, "=", 2)
+		if len(nameAndRule) != 2 || nameAndRule[0] == "" {
+			return nil, errors.New("invalid event rule: " + entry)
+		}
+		rule, err := ParseRule(nameAndRule[1], defaultDelay)
+		if err != nil {
+			return nil, err
+		}
+		if nameAndRule[0] == "*" {
+			policy.fallback = rule
+		} else {
+			policy.rules[strings.ToLower(nameAndRule[0])] = rule
+		}
+	}
+	return policy, nil
+}
+
+// ParseRule reads a single rule: immediate, delayed, delayed:<seconds> or
+// ignore. Delayed rules without a delay get the default delay.
+func ParseRule(spec string, defaultDelay time.Duration) (Rule, error) {
+	actionAndDelay := strings.SplitN(strings.TrimSpace(spec), ":", 2)
+	switch strings.ToLower(actionAndDelay[0]) {
+	case "immediate":
+		if len(actionAndDelay) == 2 {
+			return Rule{}, errors.New("immediate rules do not take a delay: " + spec)
+		}
+		return Rule{Action: Immediate}, nil
+	case "ignore":
+		if len(actionAndDelay) == 2 {
+			return Rule{}, errors.New("ignore rules do not take a delay: " + spec)
+		}
+		return Rule{Action: Ignored}, nil
+	case "delayed":
+		rule := Rule{Action: Delayed, Delay: defaultDelay}
+		if len(actionAndDelay) == 2 {
+			seconds, err := strconv.Atoi(actionAndDelay[1])
+			if err != nil || seconds <= 0 {
+				return Rule{}, errors.New("invalid delay in rule: " + spec)
+			}
+			rule.Delay = time.Duration(seconds) * time.Second
+		}
+		return rule, nil
+	}
+	return Rule{}, errors.New("unknown action in rule: " + spec)
+}
+
+// Rule returns the rule for a single event.
+func (policy *EventPolicy) Rule(event string) Rule {
+	if rule, ok := policy.rules[strings.ToLower(event)]; ok {
+		return rule
+	}
+	return policy.fallback
+}
+
+// Evaluate combines the rules of all events of a notification. If any event
+// asks for an immediate notification, it is sent right away. Otherwise the
+// shortest delay of all delayed events is used. Only if all events are
+// ignored, the notification is not sent. Without any events the rule for
+// "*" applies.
+func (policy *EventPolicy) Evaluate(events []string) Rule {
+	if len(events) == 0 {
+		return policy.fallback
+	}
+
+	result := Rule{Action: Ignored}
+	for _, event := range events {
+		rule := policy.Rule(event)
+		switch rule.Action {
+		case Immediate:
+			return rule
+		case Delayed:
+			if result.Action != Delayed || rule.Delay < result.Delay {
+				result = rule
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,140 @@
+package policy
+
+import (
+	"github.com/st3fan/dovecot-xaps-daemon/mailboxname"
+	"testing"
+	"time"
+)
+
+func TestPolicy_ParseEventPolicy(t *testing.T) {
+	policy, err := ParseEventPolicy("MessageExpunge=delayed:60, flagsset=ignore,MessageRead=immediate", 30*time.Second)
+	if err != nil {
+		t.Fatal("Cannot parse event policy", err)
+	}
+
+	tests := []struct {
+		event string
+		rule  Rule
+	}{
+		{"MessageNew", Rule{Action: Immediate}},
+		{"messageNew", Rule{Action: Immediate}},
+		{"MessageExpunge", Rule{Action: Delayed, Delay: 60 * time.Second}},
+		{"FlagsSet", Rule{Action: Ignored}},
+		{"MessageRead", Rule{Action: Immediate}},
+		{"FlagsClear", Rule{Action: Delayed, Delay: 30 * time.Second}},
+	}
+	for _, test := range tests {
+		if rule := policy.Rule(test.event); rule != test.rule {
+			t.Errorf("Rule(%q) = %v, expected %v", test.event, rule, test.rule)
+		}
+	}
+
+	policy, err = ParseEventPolicy("MessageNew=delayed:5,*=ignore", 30*time.Second)
+	if err != nil {
+		t.Fatal("Cannot parse event policy", err)
+	}
+	if rule := policy.Rule("MessageNew"); rule != (Rule{Action: Delayed, Delay: 5 * time.Second}) {
+		t.Error("MessageNew was not overridden", rule)
+	}
+	if rule := policy.Rule("FlagsSet"); rule != (Rule{Action: Ignored}) {
+		t.Error("* was not applied", rule)
+	}
+
+	for _, spec := range []string{"MessageNew", "=immediate", "MessageNew=later", "MessageNew=delayed:soon",
+		"MessageNew=delayed:0", "MessageNew=immediate:5", "MessageNew=ignore:5"} {
+		if _, err := ParseEventPolicy(spec, 30*time.Second); err == nil {
+			t.Errorf("ParseEventPolicy(%q) did not fail", spec)
+		}
+	}
+}
+
+func TestPolicy_Evaluate(t *testing.T) {
+	policy, err := ParseEventPolicy("MessageExpunge=delayed:60,FlagsClear=delayed:10,FlagsSet=ignore,MessageRead=ignore", 30*time.Second)
+	if err != nil {
+		t.Fatal("Cannot parse event policy", err)
+	}
+
+	tests := []struct {
+		events []string
+		rule   Rule
+	}{
+		{nil, Rule{Action: Delayed, Delay: 30 * time.Second}},
+		{[]string{"MessageNew"}, Rule{Action: Immediate}},
+		{[]string{"FlagsSet", "MessageExpunge", "MessageNew"}, Rule{Action: Immediate}},
+		{[]string{"MessageExpunge"}, Rule{Action: Delayed, Delay: 60 * time.Second}},
+		{[]string{"MessageExpunge", "FlagsClear"}, Rule{Action: Delayed, Delay: 10 * time.Second}},
+		{[]string{"MessageExpunge", "MailboxRename"}, Rule{Action: Delayed, Delay: 30 * time.Second}},
+		{[]string{"FlagsSet", "MessageExpunge"}, Rule{Action: Delayed, Delay: 60 * time.Second}},
+		{[]string{"FlagsSet", "MessageRead"}, Rule{Action: Ignored}},
+	}
+	for _, test := range tests {
+		if rule := policy.Evaluate(test.events); rule != test.rule {
+			t.Errorf("Evaluate(%v) = %v, expected %v", test.events, rule, test.rule)
+		}
+	}
+}
+
+func TestPolicy_MailboxPolicy(t *testing.T) {
+	policy, err := ParseMailboxPolicy("Junk=ignore, Trash=ignore,Sent*=delayed:60,Archive/*=ignore,Support=immediate", 30*time.Second)
+	if err != nil {
+		t.Fatal("Cannot parse mailbox policy", err)
+	}
+
+	tests := []struct {
+		mailbox string
+		rule    Rule
+		ok      bool
+	}{
+		{"Junk", Rule{Action: Ignored}, true},
+		{"Sent", Rule{Action: Delayed, Delay: 60 * time.Second}, true},
+		{"Sent Messages", Rule{Action: Delayed, Delay: 60 * time.Second}, true},
+		{"Archive/2019", Rule{Action: Ignored}, true},
+		{"Archive.2019", Rule{}, false},
+		{"Archive", Rule{}, false},
+		{"Support", Rule{Action: Immediate}, true},
+		{"INBOX", Rule{}, false},
+		{"Junk/Old", Rule{}, false},
+	}
+	for _, test := range tests {
+		rule, ok := policy.Rule(test.mailbox)
+		if rule != test.rule || ok != test.ok {
+			t.Errorf("Rule(%q) = %v, %v, expected %v, %v", test.mailbox, rule, ok, test.rule, test.ok)
+		}
+	}
+
+	// with a '.' separator both are the same hierarchy
+	defer func(separator string) { mailboxname.Separator = separator }(mailboxname.Separator)
+	mailboxname.Separator = "."
+	policy, err = ParseMailboxRules([]string{"Archive.*=ignore"}, 30*time.Second)
+	if err != nil {
+		t.Fatal("Cannot parse mailbox rules", err)
+	}
+	for _, mailbox := range []string{"Archive/2019", "Archive.2019"} {
+		if rule, ok := policy.Rule(mailbox); !ok || rule.Action != Ignored {
+			t.Errorf("Rule(%q) = %v, %v with a '.' separator", mailbox, rule, ok)
+		}
+	}
+
+	// the first matching pattern decides
+	policy, err = ParseMailboxRules([]string{"Support=immediate", "*=ignore"}, 30*time.Second)
+	if err != nil {
+		t.Fatal("Cannot parse mailbox rules", err)
+	}
+	if rule, _ := policy.Rule("Support"); rule.Action != Immediate {
+		t.Error("Support is not immediate", rule)
+	}
+	if rule, _ := policy.Rule("INBOX"); rule.Action != Ignored {
+		t.Error("INBOX is not ignored", rule)
+	}
+
+	var none *MailboxPolicy
+	if _, ok := none.Rule("INBOX"); ok {
+		t.Error("a nil policy matched")
+	}
+
+	for _, spec := range []string{"Junk", "=ignore", "Junk=later", "[=ignore"} {
+		if _, err := ParseMailboxPolicy(spec, 30*time.Second); err == nil {
+			t.Errorf("ParseMailboxPolicy(%q) did not fail", spec)
+		}
+	}
+}
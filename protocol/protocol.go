@@ -0,0 +1,270 @@
+// Package protocol reads and writes the lines of the socket protocol. It is
+// shared by the daemon and its clients and depends on nothing else.
+package protocol
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+)
+
+//
+// The socket protocol is line based. Every line holds one command:
+//
+//  NAME key="value"<TAB>key=("item","item")
+//
+// Commands without arguments consist of just the name.
+//
+// Every command may carry a request-id="..." argument. Its value is
+// echoed at the end of the OK or ERROR reply, after a tab:
+//
+//  OK com.apple.mail.XServer.abcd<TAB>request-id="42"
+//
+// and logged with everything that happens while handling the command.
+//
+// Values are either quoted strings or parenthesized lists of quoted
+// strings. Within a quoted string a backslash escapes the next
+// character: \t, \n and \r stand for a tab, a newline and a carriage
+// return, any other character stands for itself, so \" is a quote, \\ a
+// backslash and \' an apostrophe as escaped by Dovecot's str_escape().
+// Tabs and line breaks must always be escaped, since they separate pairs
+// and commands.
+//
+
+// parser walks over a single command line.
+type parser struct {
+	line string
+	pos  int
+}
+
+func (p *parser) done() bool {
+	return p.pos >= len(p.line)
+}
+
+func (p *parser) peek() byte {
+	return p.line[p.pos]
+}
+
+func (p *parser) expect(c byte) error {
+	if p.done() || p.peek() != c {
+		return errors.New("Failed to parse: expected '" + string(c) + "'")
+	}
+	p.pos++
+	return nil
+}
+
+// parseKey reads everything up to the next '='.
+func (p *parser) parseKey() (string, error) {
+	end := strings.IndexByte(p.line[p.pos:], '=')
+	if end == -1 {
+		return "", errors.New("Failed to parse: no name/value pair found")
+	}
+	key := p.line[p.pos : p.pos+end]
+	if key == "" || strings.ContainsAny(key, "\t\"(") {
+		return "", errors.New("Failed to parse: no name/value pair found")
+	}
+	p.pos += end + 1
+	return key, nil
+}
+
+// parseValue reads either a quoted string or a list.
+func (p *parser) parseValue() (interface{}, error) {
+	if p.done() {
+		return nil, errors.New("Failed to parse: invalid value in key/value pair")
+	}
+	switch p.peek() {
+	case '"':
+		return p.parseString()
+	case '(':
+		return p.parseList()
+	default:
+		return nil, errors.New("Failed to parse: invalid value in key/value pair")
+	}
+}
+
+func (p *parser) parseString() (string, error) {
+	if err := p.expect('"'); err != nil {
+		return "", err
+	}
+	var value strings.Builder
+	for !p.done() {
+		c := p.peek()
+		p.pos++
+		switch c {
+		case '"':
+			return value.String(), nil
+		case '\\':
+			if p.done() {
+				return "", errors.New("Failed to parse: unterminated escape sequence")
+			}
+			escaped := p.peek()
+			p.pos++
+			switch escaped {
+			case 't':
+				value.WriteByte('\t')
+			case 'n':
+				value.WriteByte('\n')
+			case 'r':
+				value.WriteByte('\r')
+			default:
+				value.WriteByte(escaped)
+			}
+		case '\t', '\n', '\r':
+			return "", errors.New("Failed to parse: unescaped control character in string")
+		default:
+			value.WriteByte(c)
+		}
+	}
+	return "", errors.New("Failed to parse: unterminated string")
+}
+
+func (p *parser) parseList() ([]string, error) {
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+	list := []string{}
+	if !p.done() && p.peek() == ')' {
+		p.pos++
+		return list, nil
+	}
+	for {
+		item, err := p.parseString()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, item)
+		if p.done() {
+			return nil, errors.New("Failed to parse: unterminated list")
+		}
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case ')':
+			p.pos++
+			return list, nil
+		default:
+			return nil, errors.New("Failed to parse: expected ',' or ')' in list")
+		}
+	}
+}
+
+// Parse parses a command line, or a record of a reply without the leading
+// "* ". String arguments are returned as string and lists as []string.
+func Parse(line string) (string, map[string]interface{}, error) {
+	name, args := "", make(map[string]interface{})
+
+	space := strings.IndexByte(line, ' ')
+	if space == -1 && line != "" && !strings.ContainsAny(line, "\t=\"(") {
+		// commands like STATUS do not take arguments
+		name = line
+		return name, args, nil
+	}
+	if space <= 0 {
+		return name, args, errors.New("Failed to parse: no name found")
+	}
+	name = line[:space]
+
+	p := &parser{line: line, pos: space + 1}
+	for {
+		key, err := p.parseKey()
+		if err != nil {
+			return name, args, err
+		}
+		value, err := p.parseValue()
+		if err != nil {
+			return name, args, err
+		}
+		args[key] = value
+
+		if p.done() {
+			return name, args, nil
+		}
+		if err := p.expect('\t'); err != nil {
+			return name, args, errors.New("Failed to parse: expected tab between key/value pairs")
+		}
+	}
+}
+
+// Quote quotes and escapes a string value, it is the inverse of
+// parser.parseString.
+func Quote(value string) string {
+	var quoted strings.Builder
+	quoted.WriteByte('"')
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '"', '\\':
+			quoted.WriteByte('\\')
+			quoted.WriteByte(c)
+		case '\t':
+			quoted.WriteString(`\t`)
+		case '\n':
+			quoted.WriteString(`\n`)
+		case '\r':
+			quoted.WriteString(`\r`)
+		default:
+			quoted.WriteByte(c)
+		}
+	}
+	quoted.WriteByte('"')
+	return quoted.String()
+}
+
+// quoteList is the inverse of parser.parseList.
+func quoteList(values []string) string {
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		quoted[i] = Quote(value)
+	}
+	return "(" + strings.Join(quoted, ",") + ")"
+}
+
+// Format is the inverse of Parse. Only string and list arguments can be
+// formatted, in the order given by keys.
+func Format(name string, keys []string, args map[string]interface{}) string {
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		switch value := args[key].(type) {
+		case string:
+			pairs = append(pairs, key+"="+Quote(value))
+		case []string:
+			pairs = append(pairs, key+"="+quoteList(value))
+		}
+	}
+	if len(pairs) == 0 {
+		return name
+	}
+	return name + " " + strings.Join(pairs, "\t")
+}
+
+// ErrLineTooLong is returned by ReadLine for lines over the maximum length.
+var ErrLineTooLong = errors.New("line too long")
+
+// ReadLine reads a single line from the reader, without the trailing line
+// break. A final line without a line break is returned too. Lines longer than
+// maxLength bytes are rejected with ErrLineTooLong, a maxLength of 0 allows
+// lines of any length.
+func ReadLine(reader *bufio.Reader, maxLength int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		// leave room for the line break
+		if maxLength > 0 && len(line) > maxLength+2 {
+			return "", ErrLineTooLong
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			return "", err
+		}
+		break
+	}
+	trimmed := strings.TrimSuffix(string(line), "\n")
+	trimmed = strings.TrimSuffix(trimmed, "\r")
+	if maxLength > 0 && len(trimmed) > maxLength {
+		return "", ErrLineTooLong
+	}
+	return trimmed, nil
+}
@@ -0,0 +1,175 @@
+package protocol
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_Parse_Escaping(t *testing.T) {
+	tests := []struct {
+		line string
+		name string
+		want interface{}
+	}{
+		{`X v="a\"b"`, "v", `a"b`},
+		{`X v="a\\b"`, "v", `a\b`},
+		{`X v="a\tb\nc\rd"`, "v", "a\tb\nc\rd"},
+		{`X v=""`, "v", ""},
+		{`X v="a,b"`, "v", "a,b"},
+		{`X v=()`, "v", []string{}},
+		{`X v=("")`, "v", []string{""}},
+		{`X v=("a,b","c\"d","e\tf")`, "v", []string{"a,b", `c"d`, "e\tf"}},
+		{`X v=("Inbox","Notes")`, "v", []string{"Inbox", "Notes"}},
+		{`X v="Entwürfe"`, "v", "Entwürfe"},
+		// Dovecot's str_escape() escapes apostrophes, str_unescape() takes
+		// every other escaped character as it is
+		{`X v="Bob\'s"`, "v", "Bob's"},
+		{`X v=("Bob\'s","\a\ü")`, "v", []string{"Bob's", "aü"}},
+	}
+	for _, test := range tests {
+		_, args, err := Parse(test.line)
+		if err != nil {
+			t.Error("Cannot parse", test.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(args[test.name], test.want) {
+			t.Errorf("%s: got %#v, want %#v", test.line, args[test.name], test.want)
+		}
+	}
+}
+
+func Test_Parse_Invalid(t *testing.T) {
+	lines := []string{
+		``,
+		`NOTIFY `,
+		`NOTIFY=`,
+		`NOTIFY v`,
+		`NOTIFY v=`,
+		`NOTIFY v=abc`,
+		`NOTIFY v="abc`,
+		`NOTIFY v="abc\`,
+		"NOTIFY v=\"a\tb\"",
+		`NOTIFY v=(`,
+		`NOTIFY v=("a"`,
+		`NOTIFY v=("a";"b")`,
+		`NOTIFY v=(a)`,
+		`NOTIFY v="a" w="b"`,
+		"NOTIFY v=\"a\"\t",
+		"NOTIFY v=\"a\"x\tw=\"b\"",
+	}
+	for _, line := range lines {
+		if _, _, err := Parse(line); err == nil {
+			t.Errorf("Parse(%q) did not fail", line)
+		}
+	}
+}
+
+func Test_Parse_NoArguments(t *testing.T) {
+	name, args, err := Parse("STATUS")
+	if err != nil {
+		t.Error("Cannot parse", err)
+	}
+	if name != "STATUS" || len(args) != 0 {
+		t.Errorf("unexpected command %s %#v", name, args)
+	}
+	if line := Format("STATUS", nil, nil); line != "STATUS" {
+		t.Errorf("Format without arguments returned %q", line)
+	}
+}
+
+func Test_ReadLine_NoLengthLimit(t *testing.T) {
+	long := "NOTIFY dovecot-username=\"" + strings.Repeat("x", 256*1024) + "\""
+	reader := bufio.NewReader(strings.NewReader(long + "\r\n" + "NOTIFY a=\"b\""))
+
+	line, err := ReadLine(reader, 0)
+	if err != nil || line != long {
+		t.Error("Cannot read a line longer than 64KB", err)
+	}
+
+	line, err = ReadLine(reader, 0)
+	if err != nil || line != `NOTIFY a="b"` {
+		t.Error("Cannot read a final line without line break", err)
+	}
+
+	if _, err = ReadLine(reader, 0); err == nil {
+		t.Error("ReadLine did not return an error at the end of the input")
+	}
+}
+
+func Test_ReadLine_LengthLimit(t *testing.T) {
+	reader := bufio.NewReader(strings.NewReader("STATUS\r\n" + strings.Repeat("x", 7) + "\n" + strings.Repeat("x", 64*1024)))
+
+	if line, err := ReadLine(reader, 6); err != nil || line != "STATUS" {
+		t.Error("Cannot read a line of the maximum length", line, err)
+	}
+	if _, err := ReadLine(reader, 6); err != ErrLineTooLong {
+		t.Error("ReadLine accepted a line over the maximum length", err)
+	}
+	if _, err := ReadLine(reader, 4096); err != ErrLineTooLong {
+		t.Error("ReadLine accepted a line longer than its buffer", err)
+	}
+}
+
+func Fuzz_Parse_RoundTrip(f *testing.F) {
+	f.Add("stefan", "INBOX", "Inbox", "Notes")
+	f.Add(`a"b`, `c\d`, "e,f", "g\th\ni")
+	f.Add("", "", "", "")
+	f.Add("(", ")", `","`, `\"`)
+
+	f.Fuzz(func(t *testing.T, username, mailbox, first, second string) {
+		args := map[string]interface{}{
+			"dovecot-username":  username,
+			"dovecot-mailbox":   mailbox,
+			"dovecot-mailboxes": []string{first, second},
+			"events":            []string{},
+		}
+		keys := []string{"dovecot-username", "dovecot-mailbox", "dovecot-mailboxes", "events"}
+		line := Format("NOTIFY", keys, args)
+		if strings.ContainsAny(line, "\n\r") {
+			t.Fatalf("formatted command contains a line break: %q", line)
+		}
+
+		name, parsed, err := Parse(line)
+		if err != nil {
+			t.Fatalf("Cannot parse %q: %s", line, err)
+		}
+		if name != "NOTIFY" || !reflect.DeepEqual(parsed, args) {
+			t.Fatalf("round trip of %q failed: got %#v, want %#v", line, parsed, args)
+		}
+	})
+}
+
+// dovecotEscape escapes like Dovecot's str_escape().
+func dovecotEscape(s string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '"' || s[i] == '\\' || s[i] == '\'' {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteByte(s[i])
+	}
+	return escaped.String()
+}
+
+func Fuzz_Parse_DovecotEscaping(f *testing.F) {
+	f.Add("Bob's")
+	f.Add(`"quoted" \path\ 'single'`)
+	f.Add(`\'`)
+	f.Add("Entwürfe")
+
+	f.Fuzz(func(t *testing.T, mailbox string) {
+		if strings.ContainsAny(mailbox, "\t\n\r") {
+			t.Skip("Dovecot does not escape control characters")
+		}
+		line := `NOTIFY dovecot-mailbox="` + dovecotEscape(mailbox) + `"`
+		_, args, err := Parse(line)
+		if err != nil {
+			t.Fatalf("Cannot parse %q: %s", line, err)
+		}
+		if args["dovecot-mailbox"] != mailbox {
+			t.Fatalf("unescaping %q failed: got %q, want %q", line, args["dovecot-mailbox"], mailbox)
+		}
+	})
+}
@@ -0,0 +1,30 @@
+package socket
+
+// errorCode is the machine readable part of an ERROR reply:
+//
+//	ERROR <code> <message>
+//
+// Clients should switch on the code, the message is meant for humans
+// and may change at any time.
+type errorCode string
+
+const (
+	// the line could not be parsed, the connection stays usable
+	errParse errorCode = "PARSE_ERROR"
+	// the command name is not known
+	errUnknownCommand errorCode = "UNKNOWN_COMMAND"
+	// a required argument is missing
+	errMissingArgument errorCode = "MISSING_ARGUMENT"
+	// an argument has the wrong type or an unsupported value
+	errInvalidArgument errorCode = "INVALID_ARGUMENT"
+	// the command needs a capability that was not negotiated with HELLO
+	errCapabilityRequired errorCode = "CAPABILITY_REQUIRED"
+	// the command was valid but could not be executed
+	errInternal errorCode = "INTERNAL_ERROR"
+	// the line is longer than allowed, the connection is closed
+	errLineTooLong errorCode = "LINE_TOO_LONG"
+	// the client was idle or too slow to send a line, the connection is closed
+	errTimeout errorCode = "TIMEOUT"
+	// the daemon serves too many connections, the connection is closed
+	errTooManyConnections errorCode = "TOO_MANY_CONNECTIONS"
+)
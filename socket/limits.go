@@ -0,0 +1,122 @@
+package socket
+
+import (
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sync"
+	"time"
+)
+
+// Limits protect the daemon from clients that connect too often, never send
+// anything or send too much.
+type Limits struct {
+	// connections served at the same time over all listeners, 0 for no limit
+	MaxConnections int
+	// how long a connection may wait between two commands, 0 for no limit
+	IdleTimeout time.Duration
+	// how long a client may take to send a command once it started, and
+	// to read a reply, 0 for no limit
+	ReadTimeout time.Duration
+	// the longest command line in bytes, 0 for no limit
+	MaxLineLength int
+}
+
+// ConnectionLimits apply to all connections of the socket and TLS listeners.
+// They have to be set before any listener is started.
+var ConnectionLimits = Limits{
+	MaxConnections: 256,
+	IdleTimeout:    5 * time.Minute,
+	ReadTimeout:    30 * time.Second,
+	MaxLineLength:  1024 * 1024,
+}
+
+var connectionsMutex = &sync.Mutex{}
+var connections int
+
+// acquireConnection reserves a connection slot. It returns false if all are
+// taken.
+func acquireConnection() bool {
+	connectionsMutex.Lock()
+	defer connectionsMutex.Unlock()
+
+	if ConnectionLimits.MaxConnections > 0 && connections >= ConnectionLimits.MaxConnections {
+		return false
+	}
+	connections++
+	return true
+}
+
+func releaseConnection() {
+	connectionsMutex.Lock()
+	connections--
+	connectionsMutex.Unlock()
+}
+
+// Rejecting a connection takes a goroutine and a file descriptor until the
+// client read the reply, so there is a limit to those as well.
+const maxRejections = 16
+
+// how long telling a client that it was rejected may take, including the
+// TLS handshake
+var rejectTimeout = time.Second
+
+// how often rejected connections are logged
+const rejectLogInterval = 10 * time.Second
+
+var rejections int
+var rejectionsLogged time.Time
+var rejectionsSuppressed int
+
+// acquireRejection reserves a slot for replying to a rejected connection. It
+// returns false if all are taken, the connection is then closed right away.
+func acquireRejection() bool {
+	connectionsMutex.Lock()
+	defer connectionsMutex.Unlock()
+
+	if rejections >= maxRejections {
+		return false
+	}
+	rejections++
+	return true
+}
+
+func releaseRejection() {
+	connectionsMutex.Lock()
+	rejections--
+	connectionsMutex.Unlock()
+}
+
+// logRejection logs a connection that was rejected because there are too
+// many. During a flood only one is logged every rejectLogInterval, together
+// with the number of those that were not.
+func logRejection(conn net.Conn) {
+	connectionsMutex.Lock()
+	defer connectionsMutex.Unlock()
+
+	if time.Since(rejectionsLogged) < rejectLogInterval {
+		rejectionsSuppressed++
+		return
+	}
+	if rejectionsSuppressed > 0 {
+		log.Warnln("Rejected connection from", conn.RemoteAddr(), ": too many connections, and", rejectionsSuppressed, "more since the last one that was logged")
+	} else {
+		log.Warnln("Rejected connection from", conn.RemoteAddr(), ": too many connections")
+	}
+	rejectionsLogged = time.Now()
+	rejectionsSuppressed = 0
+}
+
+// deadline returns the point in time a timeout ends, or no deadline at all
+// for a zero timeout.
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// isTimeout reports whether err is caused by a deadline.
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
@@ -0,0 +1,155 @@
+package socket
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_HandleRequest_Timeouts(t *testing.T) {
+	defer func(limits Limits) { ConnectionLimits = limits }(ConnectionLimits)
+
+	expectError := func(code errorCode, send string) {
+		client, server := net.Pipe()
+		defer client.Close()
+		go handleRequest(server, nil, "")
+		if send != "" {
+			go client.Write([]byte(send))
+		}
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		reader := bufio.NewReader(client)
+		reply, err := reader.ReadString('\n')
+		if err != nil || !strings.HasPrefix(reply, "ERROR "+string(code)+" ") {
+			t.Errorf("expected %s, got %q %v", code, reply, err)
+		}
+		if _, err := reader.ReadString('\n'); err == nil {
+			t.Error("connection was not closed after", code)
+		}
+	}
+
+	ConnectionLimits = Limits{IdleTimeout: 50 * time.Millisecond}
+	expectError(errTimeout, "")
+
+	ConnectionLimits = Limits{ReadTimeout: 50 * time.Millisecond}
+	expectError(errTimeout, "STATUS")
+
+	ConnectionLimits = Limits{MaxLineLength: 16, ReadTimeout: time.Second}
+	expectError(errLineTooLong, "NOTIFY dovecot-username=\""+strings.Repeat("x", 64*1024)+"\"\n")
+}
+
+func Test_Serve_MaxConnections(t *testing.T) {
+	defer func(limits Limits) { ConnectionLimits = limits }(ConnectionLimits)
+	ConnectionLimits = Limits{MaxConnections: 1}
+
+	// wait for the connections of other tests to go away
+	for i := 0; ; i++ {
+		connectionsMutex.Lock()
+		active := connections
+		connectionsMutex.Unlock()
+		if active == 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("connections of other tests are still open")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	dir, err := ioutil.TempDir("", "xapsd_limits_test")
+	if err != nil {
+		t.Fatal("Cannot create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "xapsd.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal("Cannot listen", err)
+	}
+	go serve(listener, nil, "", nil)
+
+	request := func(conn net.Conn) (string, error) {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("FROBNICATE\n"))
+		return bufio.NewReader(conn).ReadString('\n')
+	}
+
+	first, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal("Cannot connect", err)
+	}
+	if reply, err := request(first); err != nil || !strings.HasPrefix(reply, "ERROR UNKNOWN_COMMAND ") {
+		t.Fatal("first connection did not get a reply:", reply, err)
+	}
+
+	second, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal("Cannot connect", err)
+	}
+	defer second.Close()
+	if reply, err := request(second); err != nil || !strings.HasPrefix(reply, "ERROR TOO_MANY_CONNECTIONS ") {
+		t.Error("second connection was not rejected:", reply, err)
+	}
+
+	// the slot is free again once the first connection is gone
+	first.Close()
+	for i := 0; ; i++ {
+		third, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatal("Cannot connect", err)
+		}
+		reply, err := request(third)
+		third.Close()
+		if err == nil && strings.HasPrefix(reply, "ERROR UNKNOWN_COMMAND ") {
+			break
+		}
+		if i == 100 {
+			t.Fatal("connection slot was not released:", reply, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_RejectConnection_Timeout(t *testing.T) {
+	defer func(timeout time.Duration) { rejectTimeout = timeout }(rejectTimeout)
+	rejectTimeout = 50 * time.Millisecond
+
+	// a client that never reads the rejection
+	client, server := net.Pipe()
+	defer client.Close()
+	if !acquireRejection() {
+		t.Fatal("no rejection slot available")
+	}
+	done := make(chan struct{})
+	go func() {
+		rejectConnection(server)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("rejecting a connection that does not read did not time out")
+	}
+}
+
+func Test_AcquireRejection(t *testing.T) {
+	for i := 0; i < maxRejections; i++ {
+		if !acquireRejection() {
+			t.Fatal("rejection", i, "was refused")
+		}
+	}
+	if acquireRejection() {
+		t.Error("more than", maxRejections, "rejections at the same time")
+	}
+	for i := 0; i < maxRejections; i++ {
+		releaseRejection()
+	}
+	if !acquireRejection() {
+		t.Error("rejection was refused after the others were released")
+	}
+	releaseRejection()
+}
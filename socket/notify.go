@@ -0,0 +1,119 @@
+package socket
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/st3fan/dovecot-xaps-daemon/aps"
+	"github.com/st3fan/dovecot-xaps-daemon/database"
+	"github.com/st3fan/dovecot-xaps-daemon/policy"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// EventPolicy decides how the events of a notification are delivered. It has
+// to be set before any listener is started. For all possible events have a
+// look at dovecot-core:
+// grep '#define EVENT_NAME' src/plugins/push-notification/push-notification-event*
+var EventPolicy = policy.DefaultEventPolicy(30 * time.Second)
+
+// MailboxPolicy holds the global mailbox rules, which override the event
+// policy for the mailboxes they match, except for ignored events. It has to be set before any listener
+// is started.
+var MailboxPolicy = &policy.MailboxPolicy{}
+
+// userPolicy is a user's mailbox rules in parsed form.
+type userPolicy struct {
+	rules  []string
+	policy *policy.MailboxPolicy
+}
+
+var userPoliciesMutex = &sync.Mutex{}
+var userPolicies = make(map[string]userPolicy)
+
+// rememberMailboxRules keeps the parsed mailbox rules of a user, so that
+// they are not parsed again for every notification.
+func rememberMailboxRules(username string, rules []string, parsed *policy.MailboxPolicy) {
+	userPoliciesMutex.Lock()
+	defer userPoliciesMutex.Unlock()
+	if len(rules) == 0 {
+		delete(userPolicies, username)
+		return
+	}
+	userPolicies[username] = userPolicy{rules: append([]string(nil), rules...), policy: parsed}
+}
+
+// userMailboxPolicy returns the parsed form of the stored mailbox rules of a
+// user. Rules that did not come in through RULES on this daemon, for example
+// those in the database when it started, are parsed once.
+func userMailboxPolicy(username string, rules []string) (*policy.MailboxPolicy, error) {
+	userPoliciesMutex.Lock()
+	cached, ok := userPolicies[username]
+	userPoliciesMutex.Unlock()
+	if ok && reflect.DeepEqual(cached.rules, rules) {
+		return cached.policy, nil
+	}
+
+	parsed, err := policy.ParseMailboxRules(rules, EventPolicy.DefaultDelay())
+	if err != nil {
+		return nil, err
+	}
+	rememberMailboxRules(username, rules, parsed)
+	return parsed, nil
+}
+
+// mailboxRule applies the mailbox rules of the user and then the global ones
+// to the rule for the events. Events that the event policy ignores stay
+// ignored, a mailbox rule only changes how the others are delivered.
+func mailboxRule(logger *log.Entry, db database.Store, username, mailbox string, rule policy.Rule) policy.Rule {
+	if rule.Action == policy.Ignored {
+		return rule
+	}
+	userRules, err := db.MailboxRules(username)
+	if err != nil {
+		logger.Errorln("Cannot lookup mailbox rules of", username, ":", err)
+	}
+	if len(userRules) != 0 {
+		userPolicy, err := userMailboxPolicy(username, userRules)
+		if err != nil {
+			logger.Errorln("Ignoring invalid mailbox rules of", username, ":", err)
+		} else if userRule, ok := userPolicy.Rule(mailbox); ok {
+			return userRule
+		}
+	}
+	if globalRule, ok := MailboxPolicy.Rule(mailbox); ok {
+		return globalRule
+	}
+	return rule
+}
+
+// deliver notifies all devices that the user registered for the mailbox the
+// way the rule for the events says, unless a mailbox rule says otherwise.
+// This is shared by all the ways a notification can reach us. Everything
+// about the notification is logged with the logger of the request.
+func deliver(logger *log.Entry, db database.Store, username, mailbox string, rule policy.Rule) error {
+	rule = mailboxRule(logger, db, username, mailbox, rule)
+	if rule.Action == policy.Ignored {
+		logger.Debugln("Ignoring notification for", username, "/", mailbox)
+		return nil
+	}
+
+	// Find all the devices registered for this mailbox event
+	registrations, err := db.FindRegistrations(username, mailbox)
+	if err != nil {
+		return err
+	}
+	if len(registrations) == 0 {
+		logger.Debugln("No devices registered for", username, "/", mailbox)
+	}
+
+	// Send a notification to all registered devices. We ignore failures
+	// because there is not a lot we can do.
+	for _, registration := range registrations {
+		if rule.Action == policy.Immediate {
+			aps.SendNotification(registration, false, logger)
+		} else {
+			aps.SendNotificationAfter(registration, rule.Delay, logger)
+		}
+	}
+	return nil
+}
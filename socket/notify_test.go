@@ -0,0 +1,104 @@
+package socket
+
+import (
+	"github.com/st3fan/dovecot-xaps-daemon/policy"
+	"testing"
+	"time"
+)
+
+func Test_MailboxRule(t *testing.T) {
+	db, cleanup := newTestDatabase(t, "")
+	defer cleanup()
+	db.SetMailboxRules("stefan", []string{"Trash=delayed", "Support=ignore"})
+
+	defer func(previous *policy.MailboxPolicy) { MailboxPolicy = previous }(MailboxPolicy)
+	var err error
+	MailboxPolicy, err = policy.ParseMailboxPolicy("Junk=ignore,Trash=ignore,Support=immediate", time.Minute)
+	if err != nil {
+		t.Fatal("Cannot parse mailbox policy", err)
+	}
+
+	immediate := policy.Rule{Action: policy.Immediate}
+	tests := []struct {
+		username string
+		mailbox  string
+		rule     policy.Rule
+	}{
+		{"stefan", "INBOX", immediate},
+		{"stefan", "Junk", policy.Rule{Action: policy.Ignored}},
+		{"stefan", "Trash", policy.Rule{Action: policy.Delayed, Delay: EventPolicy.DefaultDelay()}},
+		{"stefan", "Support", policy.Rule{Action: policy.Ignored}},
+		{"alice", "Trash", policy.Rule{Action: policy.Ignored}},
+		{"alice", "Support", immediate},
+	}
+	for _, test := range tests {
+		if rule := mailboxRule(newRequestLogger(""), db, test.username, test.mailbox, immediate); rule != test.rule {
+			t.Errorf("mailboxRule(%q, %q) = %v, expected %v", test.username, test.mailbox, rule, test.rule)
+		}
+	}
+
+	// mailbox rules do not bring back events that the event policy ignores
+	ignored := policy.Rule{Action: policy.Ignored}
+	for _, username := range []string{"stefan", "alice"} {
+		if rule := mailboxRule(newRequestLogger(""), db, username, "Support", ignored); rule != ignored {
+			t.Errorf("mailboxRule(%q, %q) of an ignored event = %v", username, "Support", rule)
+		}
+	}
+}
+
+func Test_UserMailboxPolicy(t *testing.T) {
+	defer func() { userPolicies = make(map[string]userPolicy) }()
+
+	rules := []string{"Junk=ignore"}
+	parsed, err := userMailboxPolicy("stefan", rules)
+	if err != nil {
+		t.Fatal("Cannot parse mailbox rules", err)
+	}
+	if again, _ := userMailboxPolicy("stefan", []string{"Junk=ignore"}); again != parsed {
+		t.Error("unchanged mailbox rules were parsed again")
+	}
+	if changed, _ := userMailboxPolicy("stefan", []string{"Junk=immediate"}); changed == parsed {
+		t.Error("changed mailbox rules were not parsed again")
+	}
+	if _, err := userMailboxPolicy("alice", []string{"Junk"}); err == nil {
+		t.Error("invalid mailbox rules were accepted")
+	}
+
+	rememberMailboxRules("stefan", nil, nil)
+	if _, ok := userPolicies["stefan"]; ok {
+		t.Error("removed mailbox rules are still remembered")
+	}
+}
+
+func Test_HandleRequest_Rules(t *testing.T) {
+	db, cleanup := newTestDatabase(t, "")
+	defer cleanup()
+	conn := newTestConnection(t, db)
+	defer conn.close()
+
+	if reply := conn.send(`RULES dovecot-username="stefan"`); reply != "ERROR CAPABILITY_REQUIRED Command requires the rules capability\n" {
+		t.Error("unexpected reply to RULES without capability", reply)
+	}
+	conn.send(`HELLO protocol-version="2"	capabilities=("rules")`)
+	conn.readLine()
+
+	if reply := conn.send(`RULES dovecot-username="stefan"	mailbox-rules=("Junk=later")`); reply != "ERROR INVALID_ARGUMENT Argument mailbox-rules is invalid: unknown action in rule: later\n" {
+		t.Error("unexpected reply to invalid RULES", reply)
+	}
+
+	record, reply := conn.send(`RULES dovecot-username="stefan"	mailbox-rules=("Junk=ignore","Support=immediate")`), conn.readLine()
+	if record != "* RULES dovecot-username=\"stefan\"\tmailbox-rules=(\"Junk=ignore\",\"Support=immediate\")\n" || reply != "OK 2\n" {
+		t.Error("unexpected reply to RULES", record, reply)
+	}
+	if rules, _ := db.MailboxRules("stefan"); len(rules) != 2 {
+		t.Error("rules were not stored", rules)
+	}
+	if _, ok := userPolicies["stefan"]; !ok {
+		t.Error("stored rules were not remembered in parsed form")
+	}
+
+	record, reply = conn.send(`RULES dovecot-username="stefan"	mailbox-rules=()`), conn.readLine()
+	if record != "* RULES dovecot-username=\"stefan\"\tmailbox-rules=()\n" || reply != "OK 0\n" {
+		t.Error("unexpected reply to RULES", record, reply)
+	}
+}
@@ -0,0 +1,17 @@
+package socket
+
+import (
+	"github.com/st3fan/dovecot-xaps-daemon/protocol"
+)
+
+// command is a parsed command line, see the protocol package for the
+// syntax.
+type command struct {
+	name string
+	args map[string]interface{}
+}
+
+func parseCommand(line string) (command, error) {
+	name, args, err := protocol.Parse(line)
+	return command{name: name, args: args}, err
+}
@@ -0,0 +1,32 @@
+package socket
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// peerCredentials returns the uid and gid of the process on the other end of
+// a UNIX socket connection.
+func peerCredentials(conn net.Conn) (uint32, uint32, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return 0, 0, errors.New("not a UNIX socket connection")
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+	var ucred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if credErr != nil {
+		return 0, 0, credErr
+	}
+	return ucred.Uid, ucred.Gid, nil
+}
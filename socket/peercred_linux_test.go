@@ -0,0 +1,58 @@
+package socket
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Permissions_PeerCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xapsd_peercred_test")
+	if err != nil {
+		t.Fatal("Cannot create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	listen := func(permissions Permissions) string {
+		path := filepath.Join(dir, strconv.Itoa(len(permissions.AllowedUsers))+".sock")
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatal("Cannot listen", err)
+		}
+		authorize, err := permissions.authorizer()
+		if err != nil {
+			t.Fatal("Cannot create authorizer", err)
+		}
+		go serve(listener, nil, "", authorize)
+		return path
+	}
+
+	request := func(path string) (string, error) {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("FROBNICATE a=\"b\"\n"))
+		return bufio.NewReader(conn).ReadString('\n')
+	}
+
+	self := strconv.Itoa(os.Getuid())
+	allowed := listen(Permissions{AllowedUsers: []string{self}})
+	if reply, err := request(allowed); err != nil || !strings.HasPrefix(reply, "ERROR UNKNOWN_COMMAND ") {
+		t.Error("allowed user did not get a reply:", reply, err)
+	}
+
+	// uid 4294967294 is nobody's and the process is not running with that group
+	rejected := listen(Permissions{AllowedUsers: []string{"4294967294", "4294967293"}, AllowedGroups: []string{"4294967294"}})
+	if reply, err := request(rejected); err == nil {
+		t.Error("user that is not allowed got a reply:", reply)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package socket
+
+import (
+	"errors"
+	"net"
+)
+
+func peerCredentials(conn net.Conn) (uint32, uint32, error) {
+	return 0, 0, errors.New("checking peer credentials is only supported on Linux")
+}
@@ -0,0 +1,111 @@
+package socket
+
+import (
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// Permissions controls who may connect to the UNIX socket. Owner and Group
+// are applied to the socket file together with Mode and may be names or
+// numeric ids, as may the entries of AllowedUsers and AllowedGroups. If
+// either list is not empty, the credentials of every connecting process are
+// checked and only processes running as one of the users or with one of the
+// groups as their primary group are accepted.
+type Permissions struct {
+	Owner         string
+	Group         string
+	Mode          os.FileMode
+	AllowedUsers  []string
+	AllowedGroups []string
+}
+
+// apply sets the owner, group and mode of the socket file.
+func (p Permissions) apply(socketpath string) error {
+	uid, gid := -1, -1
+	if p.Owner != "" {
+		id, err := lookupUid(p.Owner)
+		if err != nil {
+			return err
+		}
+		uid = int(id)
+	}
+	if p.Group != "" {
+		id, err := lookupGid(p.Group)
+		if err != nil {
+			return err
+		}
+		gid = int(id)
+	}
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(socketpath, uid, gid); err != nil {
+			return err
+		}
+	}
+	return os.Chmod(socketpath, p.Mode)
+}
+
+// authorizer returns nil if every local process may connect, or a function
+// that checks the credentials of the process on the other end.
+func (p Permissions) authorizer() (func(conn net.Conn) error, error) {
+	if len(p.AllowedUsers) == 0 && len(p.AllowedGroups) == 0 {
+		return nil, nil
+	}
+
+	uids := make(map[uint32]bool)
+	for _, name := range p.AllowedUsers {
+		uid, err := lookupUid(name)
+		if err != nil {
+			return nil, err
+		}
+		uids[uid] = true
+	}
+	gids := make(map[uint32]bool)
+	for _, name := range p.AllowedGroups {
+		gid, err := lookupGid(name)
+		if err != nil {
+			return nil, err
+		}
+		gids[gid] = true
+	}
+
+	return func(conn net.Conn) error {
+		uid, gid, err := peerCredentials(conn)
+		if err != nil {
+			return err
+		}
+		if uids[uid] || gids[gid] {
+			log.Debugln("Accepted connection from uid", uid, "gid", gid)
+			return nil
+		}
+		return errors.New("uid " + strconv.FormatUint(uint64(uid), 10) + " gid " +
+			strconv.FormatUint(uint64(gid), 10) + " is not allowed")
+	}, nil
+}
+
+func lookupUid(name string) (uint32, error) {
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.ParseUint(u.Uid, 10, 32)
+	return uint32(id), err
+}
+
+func lookupGid(name string) (uint32, error) {
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.ParseUint(g.Gid, 10, 32)
+	return uint32(id), err
+}
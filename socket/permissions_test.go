@@ -0,0 +1,47 @@
+package socket
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func Test_LookupIds(t *testing.T) {
+	if uid, err := lookupUid("1234"); err != nil || uid != 1234 {
+		t.Error("Cannot lookup numeric uid", uid, err)
+	}
+	if gid, err := lookupGid("4321"); err != nil || gid != 4321 {
+		t.Error("Cannot lookup numeric gid", gid, err)
+	}
+	if uid, err := lookupUid("root"); err != nil || uid != 0 {
+		t.Error("Cannot lookup uid of root", uid, err)
+	}
+	if _, err := lookupUid("doesnotexist-xapsd"); err == nil {
+		t.Error("Looked up uid of a user that does not exist")
+	}
+	if _, err := lookupGid("doesnotexist-xapsd"); err == nil {
+		t.Error("Looked up gid of a group that does not exist")
+	}
+}
+
+func Test_Permissions_Apply(t *testing.T) {
+	f, err := ioutil.TempFile("", "xapsd_permissions_test")
+	if err != nil {
+		t.Fatal("Can't create temporary file", err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	permissions := Permissions{Group: strconv.Itoa(os.Getgid()), Mode: 0640}
+	if err := permissions.apply(f.Name()); err != nil {
+		t.Fatal("Cannot apply permissions", err)
+	}
+	info, err := os.Stat(f.Name())
+	if err != nil {
+		t.Fatal("Cannot stat file", err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("mode is %o, expected 640", info.Mode().Perm())
+	}
+}
@@ -0,0 +1,228 @@
+package socket
+
+import (
+	"github.com/st3fan/dovecot-xaps-daemon/policy"
+	"strconv"
+	"strings"
+)
+
+const mobileMailSubtopic = "com.apple.mobilemail"
+
+// problem describes one thing that is wrong with a request.
+type problem struct {
+	code    errorCode
+	message string
+}
+
+// problems collects everything that is wrong with a request, so that a client
+// learns about all of them with a single reply.
+type problems []problem
+
+func (p *problems) add(code errorCode, message string) {
+	*p = append(*p, problem{code: code, message: message})
+}
+
+// code is the code reported in the ERROR reply. Missing arguments take
+// precedence over invalid ones.
+func (p problems) code() errorCode {
+	for _, problem := range p {
+		if problem.code == errMissingArgument {
+			return errMissingArgument
+		}
+	}
+	return p[0].code
+}
+
+func (p problems) message() string {
+	messages := make([]string, len(p))
+	for i, problem := range p {
+		messages[i] = problem.message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// registerRequest holds the arguments of a REGISTER command.
+type registerRequest struct {
+	AccountId   string
+	DeviceToken string
+	Subtopic    string
+	Username    string
+	Mailboxes   []string
+}
+
+func newRegisterRequest(cmd command) (registerRequest, problems) {
+	var p problems
+	request := registerRequest{
+		AccountId:   cmd.requireString("aps-account-id", &p),
+		DeviceToken: cmd.requireString("aps-device-token", &p),
+		Subtopic:    cmd.requireString("aps-subtopic", &p),
+		Username:    cmd.requireString("dovecot-username", &p),
+		Mailboxes:   cmd.requireList("dovecot-mailboxes", &p),
+	}
+	if _, ok := cmd.args["aps-subtopic"].(string); ok && request.Subtopic != mobileMailSubtopic {
+		p.add(errInvalidArgument, "Unknown aps-subtopic")
+	}
+	return request, p
+}
+
+// notifyRequest holds the arguments of a NOTIFY command. Events is nil when
+// the client did not send any, which old plugin versions do not.
+type notifyRequest struct {
+	Username string
+	Mailbox  string
+	Events   []string
+}
+
+func newNotifyRequest(cmd command) (notifyRequest, problems) {
+	var p problems
+	request := notifyRequest{
+		Username: cmd.requireString("dovecot-username", &p),
+		Mailbox:  cmd.requireString("dovecot-mailbox", &p),
+		Events:   cmd.optionalList("events", &p),
+	}
+	return request, p
+}
+
+// requestId returns the optional request-id argument that every command may
+// carry to match its reply and log lines.
+func (cmd *command) requestId(p *problems) string {
+	value, present := cmd.args["request-id"]
+	if !present {
+		return ""
+	}
+	arg, ok := value.(string)
+	if !ok {
+		p.add(errInvalidArgument, "Argument request-id must be a string")
+	}
+	return arg
+}
+
+// requireString returns the named string argument, which must be present and
+// not empty.
+func (cmd *command) requireString(name string, p *problems) string {
+	value, present := cmd.args[name]
+	if !present {
+		p.add(errMissingArgument, "Missing "+name+" argument")
+		return ""
+	}
+	arg, ok := value.(string)
+	if !ok {
+		p.add(errInvalidArgument, "Argument "+name+" must be a string")
+		return ""
+	}
+	if arg == "" {
+		p.add(errInvalidArgument, "Argument "+name+" must not be empty")
+	}
+	return arg
+}
+
+// requireList returns the named list argument, which must be present but may
+// be empty.
+func (cmd *command) requireList(name string, p *problems) []string {
+	if _, present := cmd.args[name]; !present {
+		p.add(errMissingArgument, "Missing "+name+" argument")
+		return nil
+	}
+	return cmd.optionalList(name, p)
+}
+
+// optionalList returns the named list argument or nil if it is not present.
+func (cmd *command) optionalList(name string, p *problems) []string {
+	value, present := cmd.args[name]
+	if !present {
+		return nil
+	}
+	arg, ok := value.([]string)
+	if !ok {
+		p.add(errInvalidArgument, "Argument "+name+" must be a list")
+		return nil
+	}
+	return arg
+}
+
+// unregisterRequest holds the arguments of an UNREGISTER command. Exactly one
+// of AccountId and DeviceToken is set.
+type unregisterRequest struct {
+	Username    string
+	AccountId   string
+	DeviceToken string
+}
+
+func newUnregisterRequest(cmd command) (unregisterRequest, problems) {
+	var p problems
+	request := unregisterRequest{
+		Username: cmd.requireString("dovecot-username", &p),
+	}
+	_, hasAccountId := cmd.args["aps-account-id"]
+	_, hasDeviceToken := cmd.args["aps-device-token"]
+	switch {
+	case hasAccountId && hasDeviceToken:
+		p.add(errInvalidArgument, "Only one of aps-account-id and aps-device-token may be given")
+	case hasAccountId:
+		request.AccountId = cmd.requireString("aps-account-id", &p)
+	case hasDeviceToken:
+		request.DeviceToken = cmd.requireString("aps-device-token", &p)
+	default:
+		p.add(errMissingArgument, "Missing aps-account-id or aps-device-token argument")
+	}
+	return request, p
+}
+
+// listRequest holds the arguments of a LIST command.
+type listRequest struct {
+	Username string
+}
+
+func newListRequest(cmd command) (listRequest, problems) {
+	var p problems
+	request := listRequest{
+		Username: cmd.requireString("dovecot-username", &p),
+	}
+	return request, p
+}
+
+// rulesRequest holds the arguments of a RULES command. MailboxRules is nil
+// when the rules are only queried.
+type rulesRequest struct {
+	Username     string
+	MailboxRules []string
+	// the parsed mailbox rules, if there are any
+	MailboxPolicy *policy.MailboxPolicy
+}
+
+func newRulesRequest(cmd command) (rulesRequest, problems) {
+	var p problems
+	request := rulesRequest{
+		Username:     cmd.requireString("dovecot-username", &p),
+		MailboxRules: cmd.optionalList("mailbox-rules", &p),
+	}
+	if request.MailboxRules != nil {
+		parsed, err := policy.ParseMailboxRules(request.MailboxRules, EventPolicy.DefaultDelay())
+		if err != nil {
+			p.add(errInvalidArgument, "Argument mailbox-rules is invalid: "+err.Error())
+		}
+		request.MailboxPolicy = parsed
+	}
+	return request, p
+}
+
+// helloRequest holds the arguments of a HELLO command.
+type helloRequest struct {
+	ProtocolVersion int
+	Capabilities    []string
+}
+
+func newHelloRequest(cmd command) (helloRequest, problems) {
+	var p problems
+	request := helloRequest{
+		Capabilities: cmd.optionalList("capabilities", &p),
+	}
+	if version := cmd.requireString("protocol-version", &p); version != "" {
+		parsed, err := strconv.Atoi(version)
+		if err != nil || parsed < 1 {
+			p.add(errInvalidArgument, "Argument protocol-version must be a positive number")
+		}
+		request.ProtocolVersion = parsed
+	}
+	return request, p
+}
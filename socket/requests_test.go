@@ -0,0 +1,128 @@
+package socket
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_NewRegisterRequest(t *testing.T) {
+	valid := "REGISTER aps-account-id=\"AAA\"\taps-device-token=\"BBB\"\taps-subtopic=\"com.apple.mobilemail\"\tdovecot-username=\"stefan\"\tdovecot-mailboxes=(\"Inbox\",\"Notes\")"
+
+	tests := []struct {
+		name     string
+		line     string
+		code     errorCode
+		problems int
+	}{
+		{"valid", valid, "", 0},
+		{"empty mailboxes", "REGISTER aps-account-id=\"AAA\"\taps-device-token=\"BBB\"\taps-subtopic=\"com.apple.mobilemail\"\tdovecot-username=\"stefan\"\tdovecot-mailboxes=()", "", 0},
+		{"missing aps-account-id", "REGISTER aps-device-token=\"BBB\"\taps-subtopic=\"com.apple.mobilemail\"\tdovecot-username=\"stefan\"\tdovecot-mailboxes=(\"Inbox\")", errMissingArgument, 1},
+		{"missing aps-device-token", "REGISTER aps-account-id=\"AAA\"\taps-subtopic=\"com.apple.mobilemail\"\tdovecot-username=\"stefan\"\tdovecot-mailboxes=(\"Inbox\")", errMissingArgument, 1},
+		{"missing aps-subtopic", "REGISTER aps-account-id=\"AAA\"\taps-device-token=\"BBB\"\tdovecot-username=\"stefan\"\tdovecot-mailboxes=(\"Inbox\")", errMissingArgument, 1},
+		{"missing dovecot-username", "REGISTER aps-account-id=\"AAA\"\taps-device-token=\"BBB\"\taps-subtopic=\"com.apple.mobilemail\"\tdovecot-mailboxes=(\"Inbox\")", errMissingArgument, 1},
+		{"missing dovecot-mailboxes", "REGISTER aps-account-id=\"AAA\"\taps-device-token=\"BBB\"\taps-subtopic=\"com.apple.mobilemail\"\tdovecot-username=\"stefan\"", errMissingArgument, 1},
+		{"missing everything", "REGISTER foo=\"bar\"", errMissingArgument, 5},
+		{"unknown aps-subtopic", "REGISTER aps-account-id=\"AAA\"\taps-device-token=\"BBB\"\taps-subtopic=\"com.example\"\tdovecot-username=\"stefan\"\tdovecot-mailboxes=(\"Inbox\")", errInvalidArgument, 1},
+		{"empty aps-account-id", "REGISTER aps-account-id=\"\"\taps-device-token=\"BBB\"\taps-subtopic=\"com.apple.mobilemail\"\tdovecot-username=\"stefan\"\tdovecot-mailboxes=(\"Inbox\")", errInvalidArgument, 1},
+		{"empty aps-device-token", "REGISTER aps-account-id=\"AAA\"\taps-device-token=\"\"\taps-subtopic=\"com.apple.mobilemail\"\tdovecot-username=\"stefan\"\tdovecot-mailboxes=(\"Inbox\")", errInvalidArgument, 1},
+		{"empty dovecot-username", "REGISTER aps-account-id=\"AAA\"\taps-device-token=\"BBB\"\taps-subtopic=\"com.apple.mobilemail\"\tdovecot-username=\"\"\tdovecot-mailboxes=(\"Inbox\")", errInvalidArgument, 1},
+		{"list aps-account-id", "REGISTER aps-account-id=(\"AAA\")\taps-device-token=\"BBB\"\taps-subtopic=\"com.apple.mobilemail\"\tdovecot-username=\"stefan\"\tdovecot-mailboxes=(\"Inbox\")", errInvalidArgument, 1},
+		{"list aps-subtopic", "REGISTER aps-account-id=\"AAA\"\taps-device-token=\"BBB\"\taps-subtopic=(\"com.apple.mobilemail\")\tdovecot-username=\"stefan\"\tdovecot-mailboxes=(\"Inbox\")", errInvalidArgument, 1},
+		{"string dovecot-mailboxes", "REGISTER aps-account-id=\"AAA\"\taps-device-token=\"BBB\"\taps-subtopic=\"com.apple.mobilemail\"\tdovecot-username=\"stefan\"\tdovecot-mailboxes=\"Inbox\"", errInvalidArgument, 1},
+		{"missing and invalid", "REGISTER aps-account-id=\"\"\taps-subtopic=\"com.example\"\tdovecot-username=\"stefan\"\tdovecot-mailboxes=(\"Inbox\")", errMissingArgument, 3},
+	}
+
+	for _, test := range tests {
+		cmd, err := parseCommand(test.line)
+		if err != nil {
+			t.Fatal(test.name, "Cannot parseCommand", err)
+		}
+		request, problems := newRegisterRequest(cmd)
+		if len(problems) != test.problems {
+			t.Errorf("%s: expected %d problems, got %d: %v", test.name, test.problems, len(problems), problems)
+			continue
+		}
+		if len(problems) != 0 && problems.code() != test.code {
+			t.Errorf("%s: expected code %s, got %s", test.name, test.code, problems.code())
+		}
+		if test.problems == 0 && (request.AccountId != "AAA" || request.DeviceToken != "BBB" || request.Username != "stefan") {
+			t.Errorf("%s: unexpected request %#v", test.name, request)
+		}
+	}
+}
+
+func Test_NewNotifyRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		code     errorCode
+		problems int
+		events   []string
+	}{
+		{"valid", "NOTIFY dovecot-username=\"stefan\"\tdovecot-mailbox=\"INBOX\"\tevents=(\"MessageNew\")", "", 0, []string{"MessageNew"}},
+		{"no events", "NOTIFY dovecot-username=\"stefan\"\tdovecot-mailbox=\"INBOX\"", "", 0, nil},
+		{"empty events", "NOTIFY dovecot-username=\"stefan\"\tdovecot-mailbox=\"INBOX\"\tevents=()", "", 0, []string{}},
+		{"missing dovecot-username", "NOTIFY dovecot-mailbox=\"INBOX\"", errMissingArgument, 1, nil},
+		{"missing dovecot-mailbox", "NOTIFY dovecot-username=\"stefan\"", errMissingArgument, 1, nil},
+		{"missing everything", "NOTIFY foo=\"bar\"", errMissingArgument, 2, nil},
+		{"empty dovecot-username", "NOTIFY dovecot-username=\"\"\tdovecot-mailbox=\"INBOX\"", errInvalidArgument, 1, nil},
+		{"empty dovecot-mailbox", "NOTIFY dovecot-username=\"stefan\"\tdovecot-mailbox=\"\"", errInvalidArgument, 1, nil},
+		{"list dovecot-mailbox", "NOTIFY dovecot-username=\"stefan\"\tdovecot-mailbox=(\"INBOX\")", errInvalidArgument, 1, nil},
+		{"string events", "NOTIFY dovecot-username=\"stefan\"\tdovecot-mailbox=\"INBOX\"\tevents=\"MessageNew\"", errInvalidArgument, 1, nil},
+	}
+
+	for _, test := range tests {
+		cmd, err := parseCommand(test.line)
+		if err != nil {
+			t.Fatal(test.name, "Cannot parseCommand", err)
+		}
+		request, problems := newNotifyRequest(cmd)
+		if len(problems) != test.problems {
+			t.Errorf("%s: expected %d problems, got %d: %v", test.name, test.problems, len(problems), problems)
+			continue
+		}
+		if len(problems) != 0 && problems.code() != test.code {
+			t.Errorf("%s: expected code %s, got %s", test.name, test.code, problems.code())
+		}
+		if test.problems == 0 && !reflect.DeepEqual(request.Events, test.events) {
+			t.Errorf("%s: expected events %#v, got %#v", test.name, test.events, request.Events)
+		}
+	}
+}
+
+func Test_NewUnregisterRequest(t *testing.T) {
+	tests := []struct {
+		name        string
+		line        string
+		code        errorCode
+		problems    int
+		accountId   string
+		deviceToken string
+	}{
+		{"by account id", "UNREGISTER dovecot-username=\"stefan\"\taps-account-id=\"AAA\"", "", 0, "AAA", ""},
+		{"by device token", "UNREGISTER dovecot-username=\"stefan\"\taps-device-token=\"BBB\"", "", 0, "", "BBB"},
+		{"missing dovecot-username", "UNREGISTER aps-account-id=\"AAA\"", errMissingArgument, 1, "", ""},
+		{"missing account and token", "UNREGISTER dovecot-username=\"stefan\"", errMissingArgument, 1, "", ""},
+		{"both account and token", "UNREGISTER dovecot-username=\"stefan\"\taps-account-id=\"AAA\"\taps-device-token=\"BBB\"", errInvalidArgument, 1, "", ""},
+		{"empty account id", "UNREGISTER dovecot-username=\"stefan\"\taps-account-id=\"\"", errInvalidArgument, 1, "", ""},
+		{"list device token", "UNREGISTER dovecot-username=\"stefan\"\taps-device-token=(\"BBB\")", errInvalidArgument, 1, "", ""},
+	}
+
+	for _, test := range tests {
+		cmd, err := parseCommand(test.line)
+		if err != nil {
+			t.Fatal(test.name, "Cannot parseCommand", err)
+		}
+		request, problems := newUnregisterRequest(cmd)
+		if len(problems) != test.problems {
+			t.Errorf("%s: expected %d problems, got %d: %v", test.name, test.problems, len(problems), problems)
+			continue
+		}
+		if len(problems) != 0 && problems.code() != test.code {
+			t.Errorf("%s: expected code %s, got %s", test.name, test.code, problems.code())
+		}
+		if test.problems == 0 && (request.Username != "stefan" || request.AccountId != test.accountId || request.DeviceToken != test.deviceToken) {
+			t.Errorf("%s: unexpected request %#v", test.name, request)
+		}
+	}
+}
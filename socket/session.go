@@ -0,0 +1,231 @@
+package socket
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"github.com/st3fan/dovecot-xaps-daemon/protocol"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// protocolVersion is the newest version of the socket protocol we speak.
+// Clients that never send HELLO speak version 1.
+const protocolVersion = 2
+
+// Capabilities that can be negotiated with HELLO.
+const (
+	// NOTIFY always carries an events argument
+	capabilityEvents = "events"
+	// the UNREGISTER command
+	capabilityUnregister = "unregister"
+	// the LIST and STATUS commands
+	capabilityQuery = "query"
+	// replies are JSON objects instead of OK and ERROR lines
+	capabilityJSON = "json"
+	// the RULES command
+	capabilityRules = "rules"
+)
+
+var serverCapabilities = []string{capabilityEvents, capabilityJSON, capabilityQuery, capabilityRules, capabilityUnregister}
+
+// legacyCapabilities are enabled for clients that do not send HELLO, so that
+// they keep working the way they did before the handshake existed.
+var legacyCapabilities = map[string]bool{
+	capabilityUnregister: true,
+	capabilityQuery:      true,
+}
+
+// session holds the state of a single connection.
+type session struct {
+	conn         net.Conn
+	negotiated   bool
+	capabilities map[string]bool
+	// the request-id of the command that is being handled, if it has one
+	requestId string
+	// logs with the fields of the command that is being handled
+	logger *log.Entry
+	limits Limits
+}
+
+func newSession(conn net.Conn) *session {
+	return &session{conn: conn, capabilities: legacyCapabilities, logger: log.NewEntry(log.StandardLogger()), limits: ConnectionLimits}
+}
+
+// begin starts handling a command. The request id is echoed in the reply and
+// added to everything that is logged until the next command.
+func (s *session) begin(requestId string) {
+	s.requestId = requestId
+	s.logger = newRequestLogger(requestId)
+}
+
+func newRequestLogger(requestId string) *log.Entry {
+	if requestId == "" {
+		return log.NewEntry(log.StandardLogger())
+	}
+	return log.WithField("request-id", requestId)
+}
+
+// withRequestId appends the request id to an OK or ERROR line.
+func (s *session) withRequestId(line string) string {
+	if s.requestId == "" {
+		return line
+	}
+	return strings.Replace(line, "\t", " ", -1) + "\trequest-id=" + protocol.Quote(s.requestId)
+}
+
+// has reports whether the capability is enabled on this connection.
+func (s *session) has(capability string) bool {
+	return s.capabilities[capability]
+}
+
+// requires replies with an error unless the capability is enabled.
+func (s *session) requires(capability string) bool {
+	if s.has(capability) {
+		return true
+	}
+	s.writeError(errCapabilityRequired, "Command requires the "+capability+" capability")
+	return false
+}
+
+// negotiate settles on the highest protocol version both sides speak and the
+// capabilities both sides know.
+func negotiate(clientVersion int, clientCapabilities []string) (int, []string) {
+	version := clientVersion
+	if version > protocolVersion {
+		version = protocolVersion
+	}
+
+	wanted := make(map[string]bool)
+	for _, capability := range clientCapabilities {
+		wanted[capability] = true
+	}
+	agreed := []string{}
+	for _, capability := range serverCapabilities {
+		if wanted[capability] {
+			agreed = append(agreed, capability)
+		}
+	}
+	sort.Strings(agreed)
+	return version, agreed
+}
+
+// enable switches the session to the negotiated capabilities, they decide
+// what the session does rather than the protocol version.
+func (s *session) enable(capabilities []string) {
+	s.negotiated = true
+	s.capabilities = make(map[string]bool)
+	for _, capability := range capabilities {
+		s.capabilities[capability] = true
+	}
+}
+
+// reply is the JSON representation of an OK or ERROR line.
+type reply struct {
+	OK        bool   `json:"ok"`
+	Code      string `json:"code,omitempty"`
+	Message   string `json:"message"`
+	RequestId string `json:"request-id,omitempty"`
+}
+
+// record is the JSON representation of a line of a multi line reply.
+type record struct {
+	Record string                 `json:"record"`
+	Fields map[string]interface{} `json:"fields"`
+}
+
+// write sends data to the client, which has to read it within the read
+// timeout.
+func (s *session) write(data []byte) {
+	s.conn.SetWriteDeadline(deadline(s.limits.ReadTimeout))
+	if _, err := s.conn.Write(data); err != nil {
+		s.logger.Debugln("Cannot write reply:", err)
+	}
+}
+
+func (s *session) writeJSON(v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		s.logger.Errorln("Cannot encode reply:", err)
+		return
+	}
+	s.write(append(data, '\n'))
+}
+
+func (s *session) writeError(code errorCode, msg string) {
+	s.logger.Debugln("Returning failure:", code, msg)
+	if s.has(capabilityJSON) {
+		s.writeJSON(reply{OK: false, Code: string(code), Message: msg, RequestId: s.requestId})
+		return
+	}
+	s.write([]byte(s.withRequestId("ERROR"+" "+string(code)+" "+msg) + "\n"))
+}
+
+func (s *session) writeProblems(problems problems) {
+	s.writeError(problems.code(), problems.message())
+}
+
+// writeRecord writes one line of a multi line reply. Records use the same
+// encoding as commands, prefixed with a "* ". The reply ends with the usual
+// OK or ERROR line.
+func (s *session) writeRecord(name string, keys []string, args map[string]interface{}) {
+	if s.has(capabilityJSON) {
+		s.logger.Debugln("Returning record:", name, args)
+		s.writeJSON(record{Record: name, Fields: args})
+		return
+	}
+	s.writeRecordLine(name, keys, args)
+}
+
+func (s *session) writeRecordLine(name string, keys []string, args map[string]interface{}) {
+	line := protocol.Format(name, keys, args)
+	s.logger.Debugln("Returning record:", line)
+	s.write([]byte("* " + line + "\n"))
+}
+
+func (s *session) writeSuccess(msg string) {
+	if s.has(capabilityJSON) {
+		s.logger.Debugln("Returning success:", msg)
+		s.writeJSON(reply{OK: true, Message: msg, RequestId: s.requestId})
+		return
+	}
+	s.writeSuccessLine(msg)
+}
+
+func (s *session) writeSuccessLine(msg string) {
+	s.logger.Debugln("Returning success:", msg)
+	s.write([]byte(s.withRequestId("OK"+" "+msg) + "\n"))
+}
+
+// Handle the HELLO command. It is optional and looks as follows, with
+// the reply below it:
+//
+//	HELLO protocol-version="2" capabilities=("events","unregister")
+//	* HELLO protocol-version="2" capabilities=("events","unregister")
+//	OK 2
+//
+// The reply holds the protocol version and the capabilities that are
+// enabled on this connection from now on, which are those known to
+// both sides.
+//
+// The reply to HELLO itself is never JSON, so that a client can read it
+// before it knows what was agreed on. Without HELLO a connection speaks
+// version 1, which has UNREGISTER, LIST and STATUS but no JSON replies.
+func handleHello(s *session, cmd command) {
+	request, problems := newHelloRequest(cmd)
+	if len(problems) != 0 {
+		s.writeProblems(problems)
+		return
+	}
+
+	version, capabilities := negotiate(request.ProtocolVersion, request.Capabilities)
+	s.logger.Debugln("Negotiated protocol version", version, "with capabilities", capabilities)
+
+	s.writeRecordLine("HELLO", []string{"protocol-version", "capabilities"}, map[string]interface{}{
+		"protocol-version": strconv.Itoa(version),
+		"capabilities":     capabilities,
+	})
+	s.writeSuccessLine(strconv.Itoa(version))
+	s.enable(capabilities)
+}
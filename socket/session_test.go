@@ -0,0 +1,115 @@
+package socket
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_Negotiate(t *testing.T) {
+	tests := []struct {
+		version      int
+		capabilities []string
+		agreed       int
+		expected     []string
+	}{
+		{1, nil, 1, []string{}},
+		{2, []string{"events"}, 2, []string{"events"}},
+		{3, []string{"unregister", "json", "teleport"}, protocolVersion, []string{"json", "unregister"}},
+		{99, []string{"query", "events", "json", "unregister"}, protocolVersion, []string{"events", "json", "query", "unregister"}},
+	}
+	for _, test := range tests {
+		version, capabilities := negotiate(test.version, test.capabilities)
+		if version != test.agreed || !reflect.DeepEqual(capabilities, test.expected) {
+			t.Errorf("negotiate(%d, %v) = %d, %v", test.version, test.capabilities, version, capabilities)
+		}
+	}
+}
+
+func Test_HandleRequest_Hello(t *testing.T) {
+	db, cleanup := newTestDatabase(t, "../database/testdata/database.json")
+	defer cleanup()
+	conn := newTestConnection(t, db)
+	defer conn.close()
+
+	if reply := conn.send(`HELLO protocol-version="x"`); !strings.HasPrefix(reply, "ERROR INVALID_ARGUMENT ") {
+		t.Error("unexpected reply to invalid HELLO", reply)
+	}
+
+	hello := conn.send("HELLO protocol-version=\"7\"\tcapabilities=(\"events\",\"json\",\"teleport\")")
+	if hello != "* HELLO protocol-version=\"2\"\tcapabilities=(\"events\",\"json\")\n" {
+		t.Error("unexpected HELLO record", hello)
+	}
+	if reply := conn.readLine(); reply != "OK 2\n" {
+		t.Error("unexpected HELLO reply", reply)
+	}
+
+	// events were negotiated, so they are required now
+	var decoded reply
+	if err := json.Unmarshal([]byte(conn.send("NOTIFY dovecot-username=\"stefan\"\tdovecot-mailbox=\"Junk\"")), &decoded); err != nil {
+		t.Fatal("reply is not JSON", err)
+	}
+	if decoded.OK || decoded.Code != string(errMissingArgument) {
+		t.Error("unexpected reply to NOTIFY without events", decoded)
+	}
+
+	// unregister was not negotiated
+	if err := json.Unmarshal([]byte(conn.send("UNREGISTER dovecot-username=\"stefan\"\taps-account-id=\"AAA\"")), &decoded); err != nil {
+		t.Fatal("reply is not JSON", err)
+	}
+	if decoded.OK || decoded.Code != string(errCapabilityRequired) {
+		t.Error("unexpected reply to UNREGISTER without capability", decoded)
+	}
+
+	if err := json.Unmarshal([]byte(conn.send("NOTIFY dovecot-username=\"stefan\"\tdovecot-mailbox=\"Junk\"\tevents=(\"FlagsSet\")")), &decoded); err != nil {
+		t.Fatal("reply is not JSON", err)
+	}
+	if !decoded.OK {
+		t.Error("unexpected reply to NOTIFY", decoded)
+	}
+}
+
+func Test_HandleRequest_RequestId(t *testing.T) {
+	db, cleanup := newTestDatabase(t, "../database/testdata/database.json")
+	defer cleanup()
+
+	hook := logtest.NewGlobal()
+	defer func(level log.Level) { log.SetLevel(level) }(log.GetLevel())
+	log.SetLevel(log.DebugLevel)
+
+	conn := newTestConnection(t, db)
+	defer conn.close()
+
+	if reply := conn.send("NOTIFY dovecot-username=\"doesnotexist\"\tdovecot-mailbox=\"INBOX\"\trequest-id=\"r1\""); reply != "OK \trequest-id=\"r1\"\n" {
+		t.Errorf("unexpected reply to NOTIFY %q", reply)
+	}
+	found := false
+	for _, entry := range hook.AllEntries() {
+		if strings.HasPrefix(entry.Message, "No devices registered for") {
+			found = entry.Data["request-id"] == "r1"
+		}
+	}
+	if !found {
+		t.Error("request-id field missing from the log")
+	}
+
+	if reply := conn.send(`LIST request-id="r2"`); reply != "ERROR MISSING_ARGUMENT Missing dovecot-username argument\trequest-id=\"r2\"\n" {
+		t.Errorf("unexpected reply to LIST %q", reply)
+	}
+	if reply := conn.send(`STATUS request-id=("r3")`); reply != "ERROR INVALID_ARGUMENT Argument request-id must be a string\n" {
+		t.Errorf("unexpected reply to STATUS %q", reply)
+	}
+
+	conn.send("HELLO protocol-version=\"2\"\tcapabilities=(\"json\")")
+	conn.readLine()
+	var decoded reply
+	if err := json.Unmarshal([]byte(conn.send("NOTIFY dovecot-username=\"doesnotexist\"\tdovecot-mailbox=\"INBOX\"\trequest-id=\"r4\"")), &decoded); err != nil {
+		t.Fatal("reply is not JSON", err)
+	}
+	if !decoded.OK || decoded.RequestId != "r4" {
+		t.Error("unexpected reply to NOTIFY", decoded)
+	}
+}
@@ -2,21 +2,35 @@ package socket
 
 import (
 	"bufio"
-	"errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/st3fan/dovecot-xaps-daemon/aps"
 	"github.com/st3fan/dovecot-xaps-daemon/database"
+	"github.com/st3fan/dovecot-xaps-daemon/policy"
+	"github.com/st3fan/dovecot-xaps-daemon/protocol"
+	"io"
 	"net"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
-type command struct {
-	name string
-	args map[string]interface{}
+const acceptRetryDelay = 100 * time.Millisecond
+
+// Version of the daemon, reported by the STATUS command. It has to be set
+// before any listener is started.
+var Version string
+
+func NewSocket(socketpath string, permissions Permissions, db database.Store, topic string) {
+	listener := Listen(socketpath, permissions)
+	defer os.Remove(socketpath)
+
+	NewSocketFromListener(listener, permissions, db, topic)
 }
 
-func NewSocket(socketpath string, db *database.Database, topic string) {
+// Listen creates the UNIX socket with the given permissions.
+func Listen(socketpath string, permissions Permissions) net.Listener {
 	// Delete the socketpath if it already exists
 	if _, err := os.Stat(socketpath); err == nil {
 		err := os.Remove(socketpath)
@@ -30,215 +44,396 @@ func NewSocket(socketpath string, db *database.Database, topic string) {
 	if err != nil {
 		log.Fatalln("Could not create socketpath: ", err)
 	}
-	defer os.Remove(socketpath)
 
-	// TODO What is the proper way to limit Dovecot to this socketpath
-	err = os.Chmod(socketpath, 0777)
+	err = permissions.apply(socketpath)
+	if err != nil {
+		log.Fatalln("Could not set permissions of socketpath: ", err)
+	}
+	return listener
+}
+
+// NewSocketFromListener serves an existing UNIX socket listener, e.g. one
+// passed by systemd. Only the allowed users and groups of the permissions
+// are used, the socket file is left alone.
+func NewSocketFromListener(listener net.Listener, permissions Permissions, db database.Store, topic string) {
+	authorize, err := permissions.authorizer()
 	if err != nil {
-		log.Fatalln("Could not chmod socketpath: ", err)
+		log.Fatalln("Could not resolve allowed users and groups: ", err)
 	}
 
+	serve(listener, db, topic, authorize)
+}
+
+// serve accepts connections until the listener fails. If authorize is not
+// nil, it is called for every connection before any request is read and the
+// connection is closed when it returns an error.
+func serve(listener net.Listener, db database.Store, topic string, authorize func(conn net.Conn) error) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Println("Failed to accept connection: ", err.Error())
-			os.Exit(1)
+			// e.g. running out of file descriptors, retry after a short pause
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				log.Errorln("Failed to accept connection: ", err)
+				time.Sleep(acceptRetryDelay)
+				continue
+			}
+			log.Fatalln("Failed to accept connection: ", err)
 		}
 
 		log.Debugln("Accepted a connection")
-		go handleRequest(conn, db, topic)
-	}
-}
-
-func parseListValue(value string) ([]string, error) {
-	var list []string
-	values := strings.Split(value[1:len(value)-1], ",")
-	for _, value := range values {
-		stringValue, err := parseStringValue(value)
-		if err != nil {
-			return nil, err
+		if !acquireConnection() {
+			logRejection(conn)
+			if !acquireRejection() {
+				conn.Close()
+				continue
+			}
+			go rejectConnection(conn)
+			continue
 		}
-		list = append(list, stringValue)
+		go func() {
+			defer releaseConnection()
+			if authorize != nil {
+				if err := authorize(conn); err != nil {
+					log.Warnln("Rejected connection from", conn.RemoteAddr(), ":", err)
+					conn.Close()
+					return
+				}
+			}
+			handleRequest(conn, db, topic)
+		}()
 	}
-	return list, nil
 }
 
-func parseStringValue(value string) (string, error) {
-	return value[1 : len(value)-1], nil // TODO Escaping!
+// rejectConnection tells the client that the daemon is busy and closes the
+// connection. A client that does not take the reply in time does not get it.
+func rejectConnection(conn net.Conn) {
+	defer releaseRejection()
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(rejectTimeout))
+	s := newSession(conn)
+	s.limits.ReadTimeout = rejectTimeout
+	s.writeError(errTooManyConnections, "Too many connections, try again later")
 }
 
-func parseCommand(line string) (command, error) {
-	cmd := command{args: make(map[string]interface{})}
-
-	parts := strings.SplitN(line, " ", 2)
-	if len(parts) != 2 {
-		return cmd, errors.New("Failed to parse: no name found")
-	}
-
-	cmd.name = parts[0]
+// handleRequest serves a single connection. Whatever goes wrong here only
+// affects this connection, never the daemon or other clients.
+func handleRequest(conn net.Conn, db database.Store, topic string) {
+	defer conn.Close()
+	s := newSession(conn)
+	defer func() {
+		if r := recover(); r != nil {
+			s.logger.Errorln("Closing connection after unexpected error:", r)
+			s.writeError(errInternal, "Unexpected error, closing connection")
+		}
+	}()
 
-	for _, pair := range strings.Split(parts[1], "\t") {
-		nameAndValue := strings.SplitN(pair, "=", 2)
-		if len(nameAndValue) != 2 {
-			return cmd, errors.New("Failed to parse: no name/value pair found")
+	reader := bufio.NewReader(conn)
+	for {
+		// wait for the next command, then for the rest of its line
+		conn.SetReadDeadline(deadline(s.limits.IdleTimeout))
+		_, err := reader.Peek(1)
+		if err == nil {
+			conn.SetReadDeadline(deadline(s.limits.ReadTimeout))
+			var line string
+			line, err = protocol.ReadLine(reader, s.limits.MaxLineLength)
+			if err == nil {
+				handleLine(s, line, db, topic)
+				continue
+			}
 		}
 
+		s.begin("")
 		switch {
-		case strings.HasPrefix(nameAndValue[1], `"`) && strings.HasSuffix(nameAndValue[1], `"`):
-			value, err := parseStringValue(nameAndValue[1])
-			if err != nil {
-				return cmd, err
-			}
-			cmd.args[nameAndValue[0]] = value
-		case strings.HasPrefix(nameAndValue[1], "(") && strings.HasSuffix(nameAndValue[1], ")"):
-			value, err := parseListValue(nameAndValue[1])
-			if err != nil {
-				return cmd, err
-			}
-			cmd.args[nameAndValue[0]] = value
+		case err == io.EOF:
+			s.logger.Debugln("Connection closed by client")
+		case err == protocol.ErrLineTooLong:
+			s.logger.Warnln("Closing connection after a line longer than", s.limits.MaxLineLength, "bytes")
+			s.writeError(errLineTooLong, "Line too long, closing connection")
+		case isTimeout(err):
+			s.logger.Warnln("Closing connection after a timeout")
+			s.writeError(errTimeout, "Timeout while waiting for a command, closing connection")
 		default:
-			return cmd, errors.New("Failed to parse: invalid value in key/value pair")
+			s.logger.Errorln("Error while reading from socket, closing connection: ", err)
 		}
+		return
 	}
-
-	return cmd, nil
 }
 
-func handleRequest(conn net.Conn, db *database.Database, topic string) {
-	defer conn.Close()
+// handleLine handles a single command line.
+func handleLine(s *session, line string, db database.Store, topic string) {
+	command, err := parseCommand(line)
+	if err != nil {
+		s.begin("")
+		s.logger.Debugln("Received request:", line)
+		s.logger.Warnln("Error parsing socket data: ", err)
+		s.writeError(errParse, err.Error())
+		return
+	}
 
-	scanner := bufio.NewScanner(conn)
-	for scanner.Scan() {
-		log.Debugln("Received request:", scanner.Text())
+	var problems problems
+	s.begin(command.requestId(&problems))
+	s.logger.Debugln("Received request:", line)
+	if len(problems) != 0 {
+		s.writeProblems(problems)
+		return
+	}
 
-		command, err := parseCommand(scanner.Text())
-		if err != nil {
-			log.Fatalln("Error parsing socket data: ", err)
+	switch command.name {
+	case "HELLO":
+		handleHello(s, command)
+	case "REGISTER":
+		handleRegister(s, command, db, topic)
+	case "NOTIFY":
+		handleNotify(s, command, db)
+	case "UNREGISTER":
+		if s.requires(capabilityUnregister) {
+			handleUnregister(s, command, db)
 		}
-
-		switch command.name {
-		case "REGISTER":
-			handleRegister(conn, command, db, topic)
-		case "NOTIFY":
-			handleNotify(conn, command, db)
-		default:
-			writeError(conn, "Unknown command")
+	case "LIST":
+		if s.requires(capabilityQuery) {
+			handleList(s, command, db)
 		}
-	}
-
-	err := scanner.Err()
-	if err != nil {
-		log.Fatalln("Error while reading from socket: ", err)
+	case "STATUS":
+		if s.requires(capabilityQuery) {
+			handleStatus(s)
+		}
+	case "RULES":
+		if s.requires(capabilityRules) {
+			handleRules(s, command, db)
+		}
+	default:
+		s.writeError(errUnknownCommand, "Unknown command")
 	}
 }
 
-//
 // Handle the REGISTER command. It looks as follows:
 //
-//  REGISTER aps-account-id="AAA" aps-device-token="BBB"
-//     aps-subtopic="com.apple.mobilemail"
-//     dovecot-username="stefan"
-//     dovecot-mailboxes=("Inbox","Notes")
+//	REGISTER aps-account-id="AAA" aps-device-token="BBB"
+//	   aps-subtopic="com.apple.mobilemail"
+//	   dovecot-username="stefan"
+//	   dovecot-mailboxes=("Inbox","Notes")
 //
 // The command returns the aps-topic, which is the common name of
 // the certificate issued by OS X Server for email push
 // notifications.
-//
-func handleRegister(conn net.Conn, cmd command, db *database.Database, topic string) {
-	// Make sure the subtopic is ok
-	subtopic, ok := cmd.getStringArg("aps-subtopic")
-	if !ok {
-		writeError(conn, "Missing aps-subtopic argument")
-	}
-	if subtopic != "com.apple.mobilemail" {
-		writeError(conn, "Unknown aps-subtopic")
+func handleRegister(s *session, cmd command, db database.Store, topic string) {
+	request, problems := newRegisterRequest(cmd)
+	if len(problems) != 0 {
+		s.writeProblems(problems)
+		return
 	}
 
-	// Make sure we got the required parameters
-	accountId, ok := cmd.getStringArg("aps-account-id")
-	if !ok {
-		writeError(conn, "Missing aps-account-id argument")
-	}
-	deviceToken, ok := cmd.getStringArg("aps-device-token")
-	if !ok {
-		writeError(conn, "Missing aps-device-token argument")
-	}
-	username, ok := cmd.getStringArg("dovecot-username")
-	if !ok {
-		writeError(conn, "Missing dovecot-username argument")
-	}
-	mailboxes, ok := cmd.getListArg("dovecot-mailboxes")
-	if !ok {
-		writeError(conn, "Missing dovecot-mailboxes argument")
-	}
 	// Register this email/account-id/device-token combination
-	err := db.AddRegistration(username, accountId, deviceToken, mailboxes)
-	if !ok {
-		writeError(conn, "Failed to register client: "+err.Error())
+	err := db.AddRegistration(request.Username, request.AccountId, request.DeviceToken, request.Mailboxes)
+	if err != nil {
+		s.writeError(errInternal, "Failed to register client: "+err.Error())
+		return
 	}
-	writeSuccess(conn, topic)
+	s.writeSuccess(topic)
 }
 
-//
 // Handle the NOTIFY command. It looks as follows:
 //
-//  NOTIFY dovecot-username="stefan" dovecot-mailbox="Inbox"
+//	NOTIFY dovecot-username="stefan" dovecot-mailbox="Inbox"
 //
 // See if the the username has devices registered. If it has, loop
 // over them to find the ones that are interested in the named
-// mailbox and send those a push notificiation.
+// mailbox and send those a push notificiation, right away or later
+// as the EventPolicy says for the events.
 //
 // The push notification looks like this:
 //
-//  { "aps": { "account-id": aps-account-id } }
+//	{ "aps": { "account-id": aps-account-id } }
+func handleNotify(s *session, cmd command, db database.Store) {
+	request, problems := newNotifyRequest(cmd)
+	if len(problems) != 0 {
+		s.writeProblems(problems)
+		return
+	}
+
+	// old plugins do not send events, notify them right away like we always did
+	rule := policy.Rule{Action: policy.Immediate}
+	if request.Events == nil {
+		if s.has(capabilityEvents) {
+			s.writeError(errMissingArgument, "Missing events argument")
+			return
+		}
+		if !s.negotiated {
+			s.logger.Warnln("No events found in NOTIFY message, please update the xaps-dovecot-plugin!")
+		}
+	} else {
+		rule = EventPolicy.Evaluate(request.Events)
+	}
+
+	err := deliver(s.logger, db, request.Username, request.Mailbox, rule)
+	if err != nil {
+		s.writeError(errInternal, "Cannot lookup registrations: "+err.Error())
+		return
+	}
+	s.writeSuccess("")
+}
+
+// Handle the UNREGISTER command. It looks as follows:
+//
+//	UNREGISTER dovecot-username="stefan" aps-account-id="AAA"
+//
+// or, to revoke a device for all accounts of the user:
+//
+//	UNREGISTER dovecot-username="stefan" aps-device-token="BBB"
 //
-func handleNotify(conn net.Conn, cmd command, db *database.Database) {
-	// Make sure we got the required arguments
-	username, ok := cmd.getStringArg("dovecot-username")
-	if !ok {
-		writeError(conn, "Missing dovecot-username argument")
+// The command returns the number of removed registrations.
+func handleUnregister(s *session, cmd command, db database.Store) {
+	request, problems := newUnregisterRequest(cmd)
+	if len(problems) != 0 {
+		s.writeProblems(problems)
+		return
 	}
 
-	mailbox, ok := cmd.getStringArg("dovecot-mailbox")
-	if !ok {
-		writeError(conn, "Missing dovecot-mailbox argument")
+	removed, err := db.DeleteRegistrations(request.Username, request.AccountId, request.DeviceToken)
+	if err != nil {
+		s.writeError(errInternal, "Failed to unregister client: "+err.Error())
+		return
+	}
+	for _, registration := range removed {
+		s.logger.Infoln("Unregistered", request.Username, "/", registration.AccountId, "/", registration.DeviceToken)
+	}
+	aps.CancelNotifications(removed)
+	s.writeSuccess(strconv.Itoa(len(removed)))
+}
+
+// Handle the LIST command. It looks as follows, with the reply below it:
+//
+//	LIST dovecot-username="stefan"
+//	* REGISTRATION aps-account-id="AAA" aps-device-token="abcd...wxyz"
+//	   dovecot-mailboxes=("INBOX") registration-time="2019-03-15T23:50:14Z"
+//	OK 1
+//
+// The reply holds one line per registration, followed by OK and the
+// number of registrations.
+//
+// Device tokens are redacted, they are not needed to tell devices apart.
+func handleList(s *session, cmd command, db database.Store) {
+	request, problems := newListRequest(cmd)
+	if len(problems) != 0 {
+		s.writeProblems(problems)
+		return
 	}
 
-	isMessageNew := false
-	events, ok := cmd.getListArg("events")
-	if !ok {
-		log.Warnln("No events found in NOTIFY message, please update the xaps-dovecot-plugin!")
-		isMessageNew = true
+	accounts, err := db.ListAccounts(request.Username)
+	if err != nil {
+		s.writeError(errInternal, "Cannot lookup registrations: "+err.Error())
+		return
 	}
+	accountIds := make([]string, 0, len(accounts))
+	for accountId := range accounts {
+		accountIds = append(accountIds, accountId)
+	}
+	sort.Strings(accountIds)
 
-	// check if this is an event for a new message
-	// for all possible events have a look at dovecot-core:
-	// grep '#define EVENT_NAME' src/plugins/push-notification/push-notification-event*
-	for _, e := range events {
-		if e == "MessageNew" {
-			isMessageNew = true
+	for _, accountId := range accountIds {
+		account := accounts[accountId]
+		registrationTime := ""
+		if !account.RegistrationTime.IsZero() {
+			registrationTime = account.RegistrationTime.UTC().Format(time.RFC3339)
+		}
+		mailboxes := account.Mailboxes
+		if mailboxes == nil {
+			mailboxes = []string{}
 		}
+		s.writeRecord("REGISTRATION",
+			[]string{"aps-account-id", "aps-device-token", "dovecot-mailboxes", "registration-time"},
+			map[string]interface{}{
+				"aps-account-id":    accountId,
+				"aps-device-token":  redactDeviceToken(account.DeviceToken),
+				"dovecot-mailboxes": mailboxes,
+				"registration-time": registrationTime,
+			})
 	}
+	s.writeSuccess(strconv.Itoa(len(accountIds)))
+}
 
-	// we don't know how to handle other mboxes other than INBOX, so ignore them
-	if mailbox != "INBOX" {
-		log.Debugln("Ignoring non INBOX event for:", mailbox)
-		writeSuccess(conn, "")
+// Handle the RULES command. It replaces the mailbox rules of a user
+// and looks as follows, with the reply below it:
+//
+//	RULES dovecot-username="stefan" mailbox-rules=("Junk=ignore","Support=immediate")
+//	* RULES dovecot-username="stefan" mailbox-rules=("Junk=ignore","Support=immediate")
+//	OK 2
+//
+// An empty list removes the rules of the user, without mailbox-rules
+// the command only returns them. The reply holds the rules that are in
+// effect for the user, followed by OK and the number of rules.
+//
+// The rules of a user are checked before the global ones.
+func handleRules(s *session, cmd command, db database.Store) {
+	request, problems := newRulesRequest(cmd)
+	if len(problems) != 0 {
+		s.writeProblems(problems)
 		return
 	}
 
-	// Find all the devices registered for this mailbox event
-	registrations, err := db.FindRegistrations(username, mailbox)
+	if request.MailboxRules != nil {
+		err := db.SetMailboxRules(request.Username, request.MailboxRules)
+		if err != nil {
+			s.writeError(errInternal, "Failed to store mailbox rules: "+err.Error())
+			return
+		}
+		rememberMailboxRules(request.Username, request.MailboxRules, request.MailboxPolicy)
+		s.logger.Infoln("Mailbox rules of", request.Username, "set to", request.MailboxRules)
+	}
+
+	rules, err := db.MailboxRules(request.Username)
 	if err != nil {
-		writeError(conn, "Cannot lookup registrations: "+err.Error())
+		s.writeError(errInternal, "Cannot lookup mailbox rules: "+err.Error())
+		return
 	}
+	if rules == nil {
+		rules = []string{}
+	}
+	s.writeRecord("RULES", []string{"dovecot-username", "mailbox-rules"}, map[string]interface{}{
+		"dovecot-username": request.Username,
+		"mailbox-rules":    rules,
+	})
+	s.writeSuccess(strconv.Itoa(len(rules)))
+}
 
-	// Send a notification to all registered devices. We ignore failures
-	// because there is not a lot we can do.
-	for _, registration := range registrations {
-		aps.SendNotification(registration, !isMessageNew)
+// Handle the STATUS command. It takes no arguments and looks as follows,
+// with the reply, a single line describing the health of the daemon,
+// below it:
+//
+//	STATUS
+//	* STATUS version="1.1" aps-topic="com.apple.mail.XServer.abcd"
+//	   certificate-expiry="2019-10-01T12:00:00Z" delayed-notifications="3"
+//	   parked-notifications="0" apns-state="available"
+//	OK
+func handleStatus(s *session) {
+	status := aps.CurrentStatus()
+	certificateExpiry := ""
+	if !status.CertificateExpiry.IsZero() {
+		certificateExpiry = status.CertificateExpiry.UTC().Format(time.RFC3339)
+	}
+	apnsState := "available"
+	if status.Unavailable {
+		apnsState = "unavailable"
 	}
-	writeSuccess(conn, "")
+	s.writeRecord("STATUS",
+		[]string{"version", "aps-topic", "certificate-expiry", "delayed-notifications", "parked-notifications", "apns-state"},
+		map[string]interface{}{
+			"version":               Version,
+			"aps-topic":             status.Topic,
+			"certificate-expiry":    certificateExpiry,
+			"delayed-notifications": strconv.Itoa(status.Delayed),
+			"parked-notifications":  strconv.Itoa(status.Parked),
+			"apns-state":            apnsState,
+		})
+	s.writeSuccess("")
+}
+
+// redactDeviceToken keeps only enough of a device token to tell devices apart.
+func redactDeviceToken(deviceToken string) string {
+	if len(deviceToken) <= 8 {
+		return strings.Repeat("*", len(deviceToken))
+	}
+	return deviceToken[:4] + "..." + deviceToken[len(deviceToken)-4:]
 }
 
 func (cmd *command) getStringArg(name string) (string, bool) {
@@ -250,13 +445,3 @@ func (cmd *command) getListArg(name string) ([]string, bool) {
 	arg, ok := cmd.args[name].([]string)
 	return arg, ok
 }
-
-func writeError(conn net.Conn, msg string) {
-	log.Debugln("Returning failure:", msg)
-	conn.Write([]byte("ERROR" + " " + msg + "\n"))
-}
-
-func writeSuccess(conn net.Conn, msg string) {
-	log.Debugln("Returning success:", msg)
-	conn.Write([]byte("OK" + " " + msg + "\n"))
-}
@@ -26,9 +26,93 @@
 package socket
 
 import (
+	"bufio"
+	"github.com/st3fan/dovecot-xaps-daemon/database"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 )
 
+// newTestDatabase opens a database in a temporary directory, with the users
+// of the database file testdata or empty if testdata is empty, so that tests
+// never change the files in the repository.
+func newTestDatabase(t *testing.T, testdata string) (*database.Database, func()) {
+	dir, err := ioutil.TempDir("", "socket_test")
+	if err != nil {
+		t.Fatal("Can't create temporary directory", err)
+	}
+	filename := filepath.Join(dir, "database.json")
+	if testdata != "" {
+		data, err := ioutil.ReadFile(testdata)
+		if err == nil {
+			err = ioutil.WriteFile(filename, data, 0644)
+		}
+		if err != nil {
+			os.RemoveAll(dir)
+			t.Fatal("Cannot copy database", err)
+		}
+	}
+	db, err := database.NewDatabase(filename)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal("Cannot open database", err)
+	}
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// testConnection is the client side of a connection that is handled like
+// one accepted by the socket.
+type testConnection struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+	// closed when the connection has been handled
+	done chan struct{}
+}
+
+// newTestConnection handles a connection with db, which may be nil for
+// commands that do not use it.
+func newTestConnection(t *testing.T, db database.Store) *testConnection {
+	client, server := net.Pipe()
+	c := &testConnection{t: t, conn: client, reader: bufio.NewReader(client), done: make(chan struct{})}
+	go func() {
+		handleRequest(server, db, "")
+		close(c.done)
+	}()
+	return c
+}
+
+// send writes a command line and returns the first line of the reply.
+func (c *testConnection) send(line string) string {
+	if _, err := c.conn.Write([]byte(line + "\n")); err != nil {
+		c.t.Fatal("Cannot write to connection", err)
+	}
+	return c.readLine()
+}
+
+// readLine returns the next line of a reply.
+func (c *testConnection) readLine() string {
+	reply, err := c.reader.ReadString('\n')
+	if err != nil {
+		c.t.Fatal("Cannot read reply", err)
+	}
+	return reply
+}
+
+// close closes the connection and waits until the handler is done with it,
+// so that it does not log into the next test.
+func (c *testConnection) close() {
+	c.conn.Close()
+	<-c.done
+}
+
 func Test_ParseCommand_Register(t *testing.T) {
 	line := "REGISTER aps-account-id=\"AAA\"\taps-device-token=\"BBB\"\taps-subtopic=\"com.apple.mobilemail\"\tdovecot-username=\"stefan\"\tdovecot-mailboxes=(\"Inbox\",\"Notes\")"
 
@@ -82,3 +166,64 @@ func Test_ParseCommand_Notify(t *testing.T) {
 		t.Error(`val != "Inbox" ` + val)
 	}
 }
+
+func Test_HandleRequest_ErrorsKeepConnectionOpen(t *testing.T) {
+	conn := newTestConnection(t, nil)
+	defer conn.close()
+
+	expect := func(line, prefix string) {
+		if reply := conn.send(line); !strings.HasPrefix(reply, prefix) {
+			t.Errorf("reply to %q is %q, expected prefix %q", line, reply, prefix)
+		}
+	}
+
+	expect(`NOTIFY dovecot-username="stefan`, "ERROR PARSE_ERROR ")
+	expect(`garbage in`, "ERROR PARSE_ERROR ")
+	expect(`FROBNICATE dovecot-username="stefan"`, "ERROR UNKNOWN_COMMAND ")
+}
+
+func Test_HandleRequest_SingleReplyForInvalidCommand(t *testing.T) {
+	conn := newTestConnection(t, nil)
+	defer conn.close()
+
+	for _, line := range []string{`REGISTER aps-subtopic="com.example"`, `NOTIFY dovecot-username="stefan"`} {
+		if reply := conn.send(line); !strings.HasPrefix(reply, "ERROR MISSING_ARGUMENT ") {
+			t.Errorf("reply to %q is %q", line, reply)
+		}
+	}
+
+	// any stray OK after an ERROR would show up as the reply to this command
+	if reply := conn.send(`FROBNICATE a="b"`); !strings.HasPrefix(reply, "ERROR UNKNOWN_COMMAND ") {
+		t.Errorf("unexpected reply %q", reply)
+	}
+}
+
+func Test_HandleRequest_List(t *testing.T) {
+	db, cleanup := newTestDatabase(t, "../database/testdata/database.json")
+	defer cleanup()
+	conn := newTestConnection(t, db)
+	defer conn.close()
+
+	replies := []string{conn.send(`LIST dovecot-username="stefan"`)}
+	for strings.HasPrefix(replies[len(replies)-1], "* ") {
+		replies = append(replies, conn.readLine())
+	}
+
+	expected := []string{
+		"* REGISTRATION aps-account-id=\"stefanaccountid1\"\taps-device-token=\"stef...ken1\"\tdovecot-mailboxes=(\"Inbox\")\tregistration-time=\"\"\n",
+		"* REGISTRATION aps-account-id=\"stefanaccountid2\"\taps-device-token=\"stef...ken2\"\tdovecot-mailboxes=(\"Inbox\",\"Ham\")\tregistration-time=\"\"\n",
+		"OK 2\n",
+	}
+	if !reflect.DeepEqual(replies, expected) {
+		t.Errorf("unexpected LIST reply %q", replies)
+	}
+}
+
+func Test_RedactDeviceToken(t *testing.T) {
+	if token := redactDeviceToken("0123456789abcdef"); token != "0123...cdef" {
+		t.Error("unexpected redacted token", token)
+	}
+	if token := redactDeviceToken("short"); token != "*****" {
+		t.Error("unexpected redacted token", token)
+	}
+}
@@ -0,0 +1,95 @@
+package socket
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/st3fan/dovecot-xaps-daemon/database"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// how long a client may take to complete the TLS handshake
+const handshakeTimeout = 10 * time.Second
+
+// NewTLSSocket listens on a TCP address and speaks the same line protocol as
+// the UNIX socket, wrapped in TLS. Clients have to present a certificate that
+// was issued by the CA in clientCAFile. If allowedClients is not empty, the
+// common name or one of the DNS names of that certificate must be in it.
+func NewTLSSocket(address, certFile, keyFile, clientCAFile string, allowedClients []string, db database.Store, topic string) {
+	config, err := newTLSConfig(certFile, keyFile, clientCAFile)
+	if err != nil {
+		log.Fatalln("Could not configure TLS: ", err)
+	}
+
+	log.Debugln("Listening on TCP address", address)
+	listener, err := tls.Listen("tcp", address, config)
+	if err != nil {
+		log.Fatalln("Could not listen on TCP address: ", err)
+	}
+
+	serve(listener, db, topic, authorizeClient(allowedClients))
+}
+
+func newTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificates found in " + clientCAFile)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// authorizeClient completes the TLS handshake and checks the identity of the
+// client certificate against the allow-list.
+func authorizeClient(allowedClients []string) func(conn net.Conn) error {
+	allowed := make(map[string]bool)
+	for _, client := range allowedClients {
+		allowed[client] = true
+	}
+
+	return func(conn net.Conn) error {
+		tlsConn, ok := conn.(*tls.Conn)
+		if !ok {
+			return errors.New("not a TLS connection")
+		}
+		tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+		tlsConn.SetDeadline(time.Time{})
+
+		certificates := tlsConn.ConnectionState().PeerCertificates
+		if len(certificates) == 0 {
+			return errors.New("no client certificate")
+		}
+		identities := append([]string{certificates[0].Subject.CommonName}, certificates[0].DNSNames...)
+		if len(allowed) == 0 {
+			log.Debugln("Accepted TLS client", identities[0])
+			return nil
+		}
+		for _, identity := range identities {
+			if allowed[identity] {
+				log.Debugln("Accepted TLS client", identity)
+				return nil
+			}
+		}
+		return errors.New("client " + identities[0] + " is not allowed")
+	}
+}
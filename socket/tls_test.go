@@ -0,0 +1,128 @@
+package socket
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	der         []byte
+}
+
+func newTestCertificate(t *testing.T, name string, parent *testCertificate, isCA bool) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Cannot generate key", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.certificate, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal("Cannot create certificate", err)
+	}
+	certificate, _ := x509.ParseCertificate(der)
+	return &testCertificate{certificate: certificate, key: key, der: der}
+}
+
+func (c *testCertificate) write(t *testing.T, dir, name string) (string, string) {
+	keyDer, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal("Cannot marshal key", err)
+	}
+	certFile := filepath.Join(dir, name+"-certificate.pem")
+	keyFile := filepath.Join(dir, name+"-key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func (c *testCertificate) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func Test_TLSSocket_ClientAuthentication(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xapsd_tls_test")
+	if err != nil {
+		t.Fatal("Cannot create temporary directory", err)
+	}
+
+	ca := newTestCertificate(t, "xapsd test CA", nil, true)
+	caFile, _ := ca.write(t, dir, "ca")
+	serverCertFile, serverKeyFile := newTestCertificate(t, "xapsd", ca, false).write(t, dir, "server")
+
+	config, err := newTLSConfig(serverCertFile, serverKeyFile, caFile)
+	if err != nil {
+		t.Fatal("Cannot create TLS config", err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal("Cannot listen", err)
+	}
+	go serve(listener, nil, "", authorizeClient([]string{"dovecot1.example.com"}))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.certificate)
+
+	request := func(client *testCertificate) (string, error) {
+		clientConfig := &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}
+		if client != nil {
+			clientConfig.Certificates = []tls.Certificate{client.tlsCertificate()}
+		}
+		conn, err := tls.Dial("tcp", listener.Addr().String(), clientConfig)
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte("FROBNICATE a=\"b\"\n")); err != nil {
+			return "", err
+		}
+		return bufio.NewReader(conn).ReadString('\n')
+	}
+
+	reply, err := request(newTestCertificate(t, "dovecot1.example.com", ca, false))
+	if err != nil || !strings.HasPrefix(reply, "ERROR UNKNOWN_COMMAND ") {
+		t.Error("allowed client did not get a reply:", reply, err)
+	}
+
+	if reply, err := request(newTestCertificate(t, "intruder.example.com", ca, false)); err == nil {
+		t.Error("client that is not allowed got a reply:", reply)
+	}
+
+	other := newTestCertificate(t, "other CA", nil, true)
+	if reply, err := request(newTestCertificate(t, "dovecot1.example.com", other, false)); err == nil {
+		t.Error("client with a certificate from another CA got a reply:", reply)
+	}
+
+	if reply, err := request(nil); err == nil {
+		t.Error("client without a certificate got a reply:", reply)
+	}
+}
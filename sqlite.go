@@ -0,0 +1,12 @@
+//go:build sqlite
+
+package main
+
+import (
+	"github.com/st3fan/dovecot-xaps-daemon/database"
+	"github.com/st3fan/dovecot-xaps-daemon/database/sqlite"
+)
+
+func openSqlite(filename string) (database.Store, error) {
+	return sqlite.NewStore(filename)
+}
@@ -0,0 +1,12 @@
+//go:build !sqlite
+
+package main
+
+import (
+	"errors"
+	"github.com/st3fan/dovecot-xaps-daemon/database"
+)
+
+func openSqlite(filename string) (database.Store, error) {
+	return nil, errors.New("xapsd was built without the sqlite database driver, build it with -tags sqlite")
+}
@@ -0,0 +1,93 @@
+package systemd
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// first file descriptor passed by systemd, see sd_listen_fds(3)
+const listenFdsStart = 3
+
+// Listeners returns the sockets passed by systemd socket activation, or an
+// empty list if the daemon was not started that way. The environment
+// variables are removed, so that child processes do not inherit them.
+func Listeners() ([]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	count, err := listenFds(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"))
+	if err != nil || count == 0 {
+		return nil, err
+	}
+
+	var listeners []net.Listener
+	for fd := listenFdsStart; fd < listenFdsStart+count; fd++ {
+		syscall.CloseOnExec(fd)
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// listenFds returns the number of passed sockets if they are meant for us.
+func listenFds(pid, fds string) (int, error) {
+	if pid == "" || fds == "" {
+		return 0, nil
+	}
+	if pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+	count, err := strconv.Atoi(fds)
+	if err != nil || count < 0 {
+		return 0, errors.New("invalid LISTEN_FDS: " + fds)
+	}
+	return count, nil
+}
+
+// Notify sends a state change like "READY=1" to systemd, see sd_notify(3).
+// It does nothing if the daemon is not supervised by systemd.
+func Notify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	// abstract socket addresses are passed with a leading @
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// WatchdogInterval returns how often systemd expects a WATCHDOG=1 keep-alive,
+// or zero if the watchdog is not enabled for us.
+func WatchdogInterval() time.Duration {
+	return watchdogInterval(os.Getenv("WATCHDOG_PID"), os.Getenv("WATCHDOG_USEC"))
+}
+
+func watchdogInterval(pid, usec string) time.Duration {
+	if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	interval, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || interval <= 0 {
+		return 0
+	}
+	return time.Duration(interval) * time.Microsecond
+}
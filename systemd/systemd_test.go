@@ -0,0 +1,82 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSystemd_ListenFds(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+
+	if count, err := listenFds("", ""); err != nil || count != 0 {
+		t.Error("Expected no sockets without environment", count, err)
+	}
+	if count, err := listenFds(pid, "2"); err != nil || count != 2 {
+		t.Error("Expected 2 sockets", count, err)
+	}
+	if count, err := listenFds("1", "2"); err != nil || count != 0 {
+		t.Error("Expected no sockets that are meant for another process", count, err)
+	}
+	if _, err := listenFds(pid, "two"); err == nil {
+		t.Error("Expected an error for an invalid LISTEN_FDS")
+	}
+}
+
+func TestSystemd_WatchdogInterval(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+
+	if interval := watchdogInterval("", ""); interval != 0 {
+		t.Error("Expected no watchdog without environment", interval)
+	}
+	if interval := watchdogInterval(pid, "30000000"); interval != 30*time.Second {
+		t.Error("Expected a 30s watchdog", interval)
+	}
+	if interval := watchdogInterval("", "500000"); interval != 500*time.Millisecond {
+		t.Error("Expected a 500ms watchdog", interval)
+	}
+	if interval := watchdogInterval("1", "30000000"); interval != 0 {
+		t.Error("Expected no watchdog that is meant for another process", interval)
+	}
+}
+
+func TestSystemd_Notify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xapsd_systemd_test")
+	if err != nil {
+		t.Fatal("Cannot create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal("Cannot listen", err)
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", path)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	if err := Notify("READY=1\nSTATUS=Ready"); err != nil {
+		t.Fatal("Cannot notify", err)
+	}
+
+	buffer := make([]byte, 256)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buffer)
+	if err != nil {
+		t.Fatal("Cannot read notification", err)
+	}
+	if string(buffer[:n]) != "READY=1\nSTATUS=Ready" {
+		t.Errorf("Unexpected notification %q", buffer[:n])
+	}
+
+	os.Unsetenv("NOTIFY_SOCKET")
+	if err := Notify("READY=1"); err != nil {
+		t.Error("Notify without NOTIFY_SOCKET failed", err)
+	}
+}
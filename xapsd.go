@@ -26,41 +26,231 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"github.com/st3fan/dovecot-xaps-daemon/aps"
 	"github.com/st3fan/dovecot-xaps-daemon/database"
 	"github.com/st3fan/dovecot-xaps-daemon/logger"
+	"github.com/st3fan/dovecot-xaps-daemon/mailboxname"
+	"github.com/st3fan/dovecot-xaps-daemon/policy"
 	"github.com/st3fan/dovecot-xaps-daemon/socket"
+	"github.com/st3fan/dovecot-xaps-daemon/systemd"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 const Version = "1.1"
 
 var logLevel = flag.String("loglevel", "warn", "Loglevel: debug, error, fatal, info, panic")
 var socketpath = flag.String("socket", "/var/run/xapsd/xapsd.sock", "path to the socketpath for Dovecot")
+var socketOwner = flag.String("socketOwner", "", "user name or id that owns the socket")
+var socketGroup = flag.String("socketGroup", "", "group name or id of the socket")
+var socketMode = flag.String("socketMode", "0777", "octal permissions of the socket")
+var socketAllowedUsers = flag.String("socketAllowedUsers", "", "comma separated user names or ids that may connect to the socket, all if both this and socketAllowedGroups are empty")
+var socketAllowedGroups = flag.String("socketAllowedGroups", "", "comma separated group names or ids that may connect to the socket")
+var maxConnections = flag.Int("maxConnections", 256, "maximum number of concurrent connections on the socket and TLS listeners, 0 for no limit")
+var idleTimeout = flag.Int("idleTimeout", 300, "seconds a connection may be idle between two commands before it is closed, 0 for no limit")
+var readTimeout = flag.Int("readTimeout", 30, "seconds a client may take to send a command or to read a reply, 0 for no limit")
+var maxLineLength = flag.Int("maxLineLength", 1024*1024, "maximum length of a command in bytes, 0 for no limit")
 var checkDelayedInterval = flag.Int("delayCheckInterval", 20, "interval to check for delayed push notifications to send")
-var delayMessageTime = flag.Int("delayTime", 30, "seconds to wait until a notification for a non NewMessage event gets sent")
+var delayMessageTime = flag.Int("delayTime", 30, "seconds to wait until a notification for a delayed event gets sent")
+var eventPolicy = flag.String("eventPolicy", "", "comma separated event=rule pairs, rules are immediate, delayed, delayed:<seconds> or ignore, e.g. MessageExpunge=delayed:60,FlagsSet=ignore,*=delayed")
+var mailboxPolicy = flag.String("mailboxPolicy", "", "comma separated mailbox=rule pairs that override the event policy, mailboxes may be glob patterns, e.g. Junk=ignore,Trash=ignore,Support=immediate")
+var mailboxSeparator = flag.String("mailboxSeparator", "/", "hierarchy separator of the mailbox names of Dovecot, / or ., with . a '.' in a name separates hierarchy levels")
 var apnsFeedbackTime = flag.Int("feedbackInterval", 0, "interval in minutes after which APNS feedback service is queried")
 var databasefile = flag.String("database", "/var/lib/xapsd/databasefile.json", "path to the databasefile file")
+var databaseDriver = flag.String("database-driver", "json", "how the database is stored: json or sqlite")
+var databaseCompactAfter = flag.Int("databaseCompactAfter", 1000, "number of changes in the journal of the json database after which a new database file is written")
+var databaseCompactInterval = flag.Int("databaseCompactInterval", 3600, "seconds after which the changes to the json database are written to a new database file, 0 to only do that after databaseCompactAfter changes")
+var databaseBackups = flag.Int("databaseBackups", 3, "number of previous versions of the json database file that are kept as <database>.1 to <database>.N")
 var key = flag.String("key", "/etc/xapsd/key.pem", "path to the pem file containing the private key")
 var certificate = flag.String("certificate", "/etc/xapsd/certificate.pem", "path to the pem file containing the certificate")
 var redisEnabled = flag.Bool("redisEnabled", false, "Enable Redis to synchronize APNS Feedback Service")
 var redisUrl = flag.String("redisUrl", "localhost:6379", "redis URL")
 var redisPassword = flag.String("redisPassword", "", "redis Password")
 var redisDb = flag.Int("redisDb", 0, "redis Database")
+var apnsFailureThreshold = flag.Int("apnsFailureThreshold", 3, "consecutive APNS delivery failures after which notifications are parked")
+var apnsMinBackoff = flag.Int("apnsMinBackoff", 1, "seconds to wait before the APNS gateway is probed again after an outage")
+var apnsMaxBackoff = flag.Int("apnsMaxBackoff", 300, "maximum seconds between two probes of an unavailable APNS gateway")
 
+var tlsListen = flag.String("tlsListen", "", "TCP address to accept TLS connections from remote Dovecot backends on, e.g. :2196")
+var tlsCertificate = flag.String("tlsCertificate", "/etc/xapsd/tls-certificate.pem", "path to the pem file containing the certificate of the TLS listener")
+var tlsKey = flag.String("tlsKey", "/etc/xapsd/tls-key.pem", "path to the pem file containing the private key of the TLS listener")
+var tlsClientCA = flag.String("tlsClientCA", "/etc/xapsd/tls-client-ca.pem", "path to the pem file containing the CA that issues client certificates")
+var tlsAllowedClients = flag.String("tlsAllowedClients", "", "comma separated common or DNS names of the client certificates that may connect, all if empty")
+var httpListen = flag.String("httpListen", "", "TCP address to accept notifications from the HTTP push drivers of Dovecot on, e.g. 127.0.0.1:8181")
+var httpUsername = flag.String("httpUsername", "", "username that HTTP requests must authenticate with, no authentication if empty, which is only allowed on a loopback address")
+var httpPassword = flag.String("httpPassword", "", "password that HTTP requests must authenticate with")
 
 func main() {
 	flag.Parse()
 	logger.ParseLoglevel(*logLevel)
 
-	log.Debugln("Opening databasefile at", *databasefile)
-	db, err := database.NewDatabase(*databasefile)
+	listeners, err := systemd.Listeners()
 	if err != nil {
-		log.Fatal("Cannot open databasefile: ", *databasefile)
+		log.Fatal("Cannot use sockets passed by systemd: ", err)
 	}
-	topic := aps.NewApns(*certificate, *key, *checkDelayedInterval, *delayMessageTime, *apnsFeedbackTime, db, *redisEnabled, *redisUrl, *redisPassword, *redisDb)
 
-	log.Printf("Starting xapsd %s on %s", Version, *socketpath)
-	socket.NewSocket(*socketpath, db, topic)
+	if *mailboxSeparator != "/" && *mailboxSeparator != "." {
+		log.Fatalln("Unknown mailbox separator: ", *mailboxSeparator)
+	}
+	mailboxname.Separator = *mailboxSeparator
+
+	eventRules, err := policy.ParseEventPolicy(*eventPolicy, time.Second*time.Duration(*delayMessageTime))
+	if err != nil {
+		log.Fatalln("Cannot parse event policy: ", err)
+	}
+
+	mailboxRules, err := policy.ParseMailboxPolicy(*mailboxPolicy, time.Second*time.Duration(*delayMessageTime))
+	if err != nil {
+		log.Fatalln("Cannot parse mailbox policy: ", err)
+	}
+
+	systemd.Notify("STATUS=Opening database")
+	log.Debugln("Opening", *databaseDriver, "databasefile at", *databasefile)
+	database.Backups = *databaseBackups
+	database.CompactAfter = *databaseCompactAfter
+	database.CompactInterval = time.Second * time.Duration(*databaseCompactInterval)
+	var db database.Store
+	switch *databaseDriver {
+	case "json":
+		db, err = database.NewDatabase(*databasefile)
+	case "sqlite":
+		db, err = openSqlite(*databasefile)
+	default:
+		log.Fatalln("Unknown database driver: ", *databaseDriver)
+	}
+	if err != nil {
+		log.Fatal("Cannot open databasefile: ", *databasefile, ": ", err)
+	}
+
+	systemd.Notify("STATUS=Connecting to APNS")
+	topic := aps.NewApns(*certificate, *key, *checkDelayedInterval, *delayMessageTime, *apnsFeedbackTime, db, *redisEnabled, *redisUrl, *redisPassword, *redisDb, *apnsFailureThreshold, *apnsMinBackoff, *apnsMaxBackoff)
+
+	socket.Version = Version
+	socket.EventPolicy = eventRules
+	socket.MailboxPolicy = mailboxRules
+	socket.ConnectionLimits = socket.Limits{
+		MaxConnections: *maxConnections,
+		IdleTimeout:    time.Second * time.Duration(*idleTimeout),
+		ReadTimeout:    time.Second * time.Duration(*readTimeout),
+		MaxLineLength:  *maxLineLength,
+	}
+	if *tlsListen != "" {
+		log.Printf("Starting xapsd %s on %s", Version, *tlsListen)
+		go socket.NewTLSSocket(*tlsListen, *tlsCertificate, *tlsKey, *tlsClientCA, splitList(*tlsAllowedClients), db, topic)
+	}
+
+	if *httpListen != "" {
+		log.Printf("Starting xapsd %s on %s", Version, *httpListen)
+		go socket.NewHTTPServer(*httpListen, *httpUsername, *httpPassword, db, topic)
+	}
+
+	mode, err := strconv.ParseUint(*socketMode, 8, 32)
+	if err != nil {
+		log.Fatal("Invalid socket mode: ", *socketMode)
+	}
+	permissions := socket.Permissions{
+		Owner:         *socketOwner,
+		Group:         *socketGroup,
+		Mode:          os.FileMode(mode),
+		AllowedUsers:  splitList(*socketAllowedUsers),
+		AllowedGroups: splitList(*socketAllowedGroups),
+	}
+
+	// the socket we create ourselves is removed when we stop
+	var created string
+	if len(listeners) == 0 {
+		log.Printf("Starting xapsd %s on %s", Version, *socketpath)
+		listeners = append(listeners, socket.Listen(*socketpath, permissions))
+		created = *socketpath
+	} else {
+		log.Printf("Starting xapsd %s on %d sockets passed by systemd", Version, len(listeners))
+	}
+	for _, listener := range listeners[1:] {
+		go socket.NewSocketFromListener(listener, permissions, db, topic)
+	}
+
+	systemd.Notify("READY=1\nSTATUS=Ready")
+	go watchdog(db)
+	go closeOnSignal(db, created)
+
+	socket.NewSocketFromListener(listeners[0], permissions, db, topic)
+}
+
+// closeOnSignal closes the database when the daemon is stopped, which writes
+// the journal of the json database to the database file, and removes the
+// socket at socketpath unless it is empty. os.Exit skips deferred calls, so
+// this is the only place to clean up.
+func closeOnSignal(db database.Store, socketpath string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	log.Infoln("Stopping on", <-signals)
+	systemd.Notify("STOPPING=1")
+	if err := db.Close(); err != nil {
+		log.Errorln("Cannot close database:", err)
+	}
+	if socketpath != "" {
+		if err := os.Remove(socketpath); err != nil && !os.IsNotExist(err) {
+			log.Errorln("Cannot remove socket:", err)
+		}
+	}
+	os.Exit(0)
+}
+
+// watchdog keeps systemd informed that we are alive and how APNS is doing.
+// We are only alive if the database still answers, a daemon that hangs on a
+// lock or a broken disk is restarted by systemd.
+func watchdog(db database.Store) {
+	interval := systemd.WatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	for range time.Tick(interval / 2) {
+		if err := checkDatabase(db, interval/2); err != nil {
+			log.Errorln("Not sending a keep-alive to the watchdog:", err)
+			systemd.Notify("STATUS=" + err.Error())
+			continue
+		}
+		status := aps.CurrentStatus()
+		state := "Ready"
+		if status.Unavailable {
+			state = "APNS unavailable"
+		}
+		systemd.Notify(fmt.Sprintf("WATCHDOG=1\nSTATUS=%s, %d delayed and %d parked notifications",
+			state, status.Delayed, status.Parked))
+	}
+}
+
+// checkDatabase reads from the database like a request would. It fails if
+// that takes longer than timeout, the read is left running then.
+func checkDatabase(db database.Store, timeout time.Duration) error {
+	result := make(chan error, 1)
+	go func() {
+		_, err := db.ListAccounts("")
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		if err != nil {
+			return errors.New("Cannot read database: " + err.Error())
+		}
+		return nil
+	case <-time.After(timeout):
+		return errors.New("Database did not answer within " + timeout.String())
+	}
+}
+
+// splitList splits a comma separated flag value, an empty value is an empty list
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
 }